@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kong/proxy-wasm-go-rate-limiting/config"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// -----------------------------------------------------------------------------
+// Batched Increments
+// -----------------------------------------------------------------------------
+
+type pendingHits struct {
+	hits counterRecord        // hits not written to the store yet, per period
+	end  [recordPeriods]int64 // when the window of each period expires
+	full bool                 // the last flush failed as the store was full
+}
+
+// Batch accumulates hits in the memory of the worker and writes them to the
+// store once per flush period, instead of once per request and period. The
+// worker counts its own pending hits when checking limits, but other workers
+// only see them once flushed: limits can be exceeded by the hits of the other
+// workers during one flush period. Hits which could not be written are
+// kept for the next flush; while the store is full, further requests of
+// their key are not counted, as they would not be without batches.
+type Batch struct {
+	conf      *config.Config
+	pending   map[string]*pendingHits
+	nextFlush int64 // in milliseconds
+}
+
+func newBatch(conf *config.Config) *Batch {
+	return &Batch{
+		conf:    conf,
+		pending: make(map[string]*pendingHits),
+	}
+}
+
+func (b *Batch) add(key string, period string, ts *Timestamps, hits int64) {
+	p := b.pending[key]
+	if p == nil {
+		p = &pendingHits{}
+		b.pending[key] = p
+	}
+	p.hits.add(period, ts.start[period], hits)
+	p.end[periodIndex(period)] = ts.end[period]
+}
+
+// unflushed returns the hits of the window not written to the store yet
+func (b *Batch) unflushed(key string, period string, window int64) int64 {
+	p := b.pending[key]
+	if p == nil {
+		return 0
+	}
+	return p.hits.get(period, window)
+}
+
+// full tells whether the hits of the key could not be flushed last time as
+// the store was full
+func (b *Batch) full(key string) bool {
+	p := b.pending[key]
+	return p != nil && p.full
+}
+
+// onTick flushes the pending hits, and records them for the next
+// synchronization under the cluster policy.
+func (b *Batch) onTick(now time.Time, cluster *Cluster) {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	if ms < b.nextFlush {
+		return
+	}
+	b.nextFlush = ms + b.conf.FlushPeriod
+
+	for key, p := range b.pending {
+		// Hits of an expired window no longer count
+		flushed := []string{}
+		for i, period := range periods {
+			if p.hits.hits[i] > 0 && p.end[i] > now.Unix() {
+				flushed = append(flushed, period)
+			}
+		}
+		if len(flushed) == 0 {
+			delete(b.pending, key)
+			continue
+		}
+
+		// Hits which could not be written are kept for the next flush
+		if err := flush(key, p, flushed); err != nil {
+			if err == errStoreFull {
+				storeFullCounter.Increment(1)
+				p.full = true
+			}
+			proxywasm.LogErrorf("could not flush counters %q: %v", key, err)
+			continue
+		}
+		delete(b.pending, key)
+
+		if cluster != nil {
+			for _, period := range flushed {
+				i := periodIndex(period)
+				cluster.record(key, period, p.hits.window[i], p.end[i], p.hits.hits[i])
+			}
+		}
+	}
+}
+
+// flush writes the pending hits of the periods to the record of the key
+func flush(key string, p *pendingHits, periods []string) error {
+	rec, cas, err := readRecord(key)
+	if err != nil {
+		return err
+	}
+
+	return updateRecord(key, rec, cas, func(rec *counterRecord) bool {
+		for _, period := range periods {
+			i := periodIndex(period)
+			rec.add(period, p.hits.window[i], p.hits.hits[i])
+		}
+		return true
+	})
+}
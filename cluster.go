@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kong/proxy-wasm-go-rate-limiting/config"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// -----------------------------------------------------------------------------
+// Cluster Policy
+// -----------------------------------------------------------------------------
+
+// Under the cluster policy, requests are counted in the local store as
+// under the local policy, and counters are periodically synchronized with
+// the other nodes through an upstream, off the request path.
+//
+// The synchronization call is a POST of one line per counter touched in its
+// current window, holding the window start, the hits counted locally since
+// the last call and the key of the counter, as given by getPeriodKey:
+//
+//	<window> <delta> <key>\n
+//
+// The upstream adds the deltas of all nodes and answers 200 with a line per
+// counter holding its total across the cluster, in the same format:
+//
+//	<window> <total> <key>\n
+//
+// Keys are hashes, which hold no spaces. A total for an earlier window than
+// the current one of the node is ignored.
+
+// Counters are named after the key of their record and their period
+func getPeriodKey(key string, period string) string {
+	return key + ":" + period
+}
+
+type clusterCounter struct {
+	key    string // key of the record holding the counter
+	period string
+	window int64 // start of the window of the counter
+	end    int64 // when the window, and thus the counter, expires
+	delta  int64 // hits counted locally and not pushed yet
+}
+
+// Cluster tracks, per worker, the counters to synchronize
+type Cluster struct {
+	conf     *config.Config
+	counters map[string]*clusterCounter // by period key
+	syncing  bool
+	calls    int                       // calls dispatched, telling late responses apart
+	started  int64                     // when the pending call was dispatched, in milliseconds
+	pushed   map[string]clusterCounter // deltas of the pending call
+	nextSync int64                     // in milliseconds
+}
+
+func newCluster(conf *config.Config) *Cluster {
+	return &Cluster{
+		conf:     conf,
+		counters: make(map[string]*clusterCounter),
+	}
+}
+
+// record counts hits saved in the local store, to be pushed on next sync
+func (c *Cluster) record(key string, period string, window int64, end int64, hits int64) {
+	periodKey := getPeriodKey(key, period)
+	counter := c.counters[periodKey]
+	if counter == nil || counter.window != window {
+		counter = &clusterCounter{key: key, period: period, window: window, end: end}
+		c.counters[periodKey] = counter
+	}
+	counter.delta += hits
+}
+
+func (c *Cluster) onTick(now time.Time) {
+	ms := now.UnixNano() / int64(time.Millisecond)
+
+	// The host may never call back, such as when the upstream cannot be
+	// resolved: a call is given up once past its timeout
+	if c.syncing {
+		if ms < c.started+c.conf.SyncTimeout {
+			return
+		}
+		proxywasm.LogErrorf("synchronization call timed out without a response")
+		c.syncing = false
+		c.restore(c.pushed)
+	}
+
+	if ms < c.nextSync {
+		return
+	}
+	c.nextSync = ms + c.conf.SyncPeriod
+
+	var body bytes.Buffer
+	pushed := make(map[string]clusterCounter)
+
+	for key, counter := range c.counters {
+		if counter.end <= now.Unix() {
+			delete(c.counters, key)
+			continue
+		}
+
+		fmt.Fprintf(&body, "%d %d %s\n", counter.window, counter.delta, key)
+		pushed[key] = *counter
+		counter.delta = 0
+	}
+
+	if len(pushed) == 0 {
+		return
+	}
+
+	headers := [][2]string{
+		{":method", "POST"},
+		{":path", c.conf.SyncPath},
+		{":authority", c.conf.SyncUpstream},
+		{"content-type", "text/plain"},
+	}
+
+	c.calls++
+	call := c.calls
+	_, err := proxywasm.DispatchHttpCall(c.conf.SyncUpstream, headers, body.Bytes(), nil,
+		uint32(c.conf.SyncTimeout), func(numHeaders, bodySize, numTrailers int) {
+			// Deltas of a call given up were restored already
+			if !c.syncing || call != c.calls {
+				return
+			}
+			c.syncing = false
+			c.onResponse(pushed, bodySize)
+		})
+	if err != nil {
+		proxywasm.LogErrorf("could not synchronize counters: %v", err)
+		c.restore(pushed)
+		return
+	}
+
+	c.syncing = true
+	c.started = ms
+	c.pushed = pushed
+}
+
+// restore puts back deltas which could not be pushed, for the next sync
+func (c *Cluster) restore(pushed map[string]clusterCounter) {
+	for key, p := range pushed {
+		counter := c.counters[key]
+		if counter != nil && counter.window == p.window {
+			counter.delta += p.delta
+		}
+	}
+}
+
+func (c *Cluster) onResponse(pushed map[string]clusterCounter, bodySize int) {
+	status := ""
+	headers, err := proxywasm.GetHttpCallResponseHeaders()
+	for _, h := range headers {
+		if h[0] == ":status" {
+			status = h[1]
+		}
+	}
+	if err != nil || status != "200" {
+		proxywasm.LogErrorf("could not synchronize counters: sync upstream answered status %q", status)
+		c.restore(pushed)
+		return
+	}
+
+	body, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
+	if err != nil && err != types.ErrorStatusNotFound {
+		proxywasm.LogErrorf("could not synchronize counters: %v", err)
+		c.restore(pushed)
+		return
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			proxywasm.LogWarnf("ignoring malformed counter from sync upstream: %q", line)
+			continue
+		}
+		window, err1 := strconv.ParseInt(fields[0], 10, 64)
+		total, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			proxywasm.LogWarnf("ignoring malformed counter from sync upstream: %q", line)
+			continue
+		}
+
+		c.merge(fields[2], window, total)
+	}
+}
+
+// merge raises the local counter to the total of the cluster, plus the hits
+// counted locally since the sync call. Local hits not pushed yet by other
+// workers are kept by never lowering the counter.
+func (c *Cluster) merge(periodKey string, window int64, total int64) {
+	counter := c.counters[periodKey]
+	if counter == nil || counter.window != window {
+		return
+	}
+	value := total + counter.delta
+
+	rec, cas, err := readRecord(counter.key)
+	if err == nil {
+		err = updateRecord(counter.key, rec, cas, func(rec *counterRecord) bool {
+			if rec.get(counter.period, window) >= value {
+				return false
+			}
+			rec.set(counter.period, window, value)
+			return true
+		})
+	}
+	if err != nil {
+		proxywasm.LogErrorf("could not merge counter %q: %v", periodKey, err)
+	}
+}
@@ -1,32 +1,65 @@
 package config
 
 import (
-	"github.com/pquerna/ffjson/ffjson"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
 )
 
 // -----------------------------------------------------------------------------
 // Instance Config
 // -----------------------------------------------------------------------------
-//go:generate ffjson -noencoder $GOFILE
+//go:generate go run ../tools/metaschema ../rate-limiting.meta.json
 
 type Config struct {
+	// Reject (true) or ignore with a warning (false) unknown fields
+	Strict bool `json:"strict" jsonschema:"default=true"`
+
 	// Accepted hits per second
-	Second int64 `json:"second"`
+	Second int64 `json:"second" jsonschema:"minimum=-1"`
 
 	// Accepted hits per minute
-	Minute int64 `json:"minute"`
+	Minute int64 `json:"minute" jsonschema:"minimum=-1"`
 
 	// Accepted hits per hour
-	Hour int64 `json:"hour"`
+	Hour int64 `json:"hour" jsonschema:"minimum=-1"`
 
 	// Accepted hits per day
-	Day int64 `json:"day"`
+	Day int64 `json:"day" jsonschema:"minimum=-1"`
 
 	// Accepted hits per month
-	Month int64 `json:"month"`
+	Month int64 `json:"month" jsonschema:"minimum=-1"`
 
 	// Accepted hits per year
-	Year int64 `json:"year"`
+	Year int64 `json:"year" jsonschema:"minimum=-1"`
+
+	// Streams to limit: HTTP requests, or connections when running as a TCP filter
+	Protocol string `json:"protocol" jsonschema:"enum=http,enum=tcp,default=http"`
+
+	// Maximum concurrent TCP connections per source address, or -1 for no limit
+	MaxConnections int64 `json:"max_connections" jsonschema:"minimum=-1,default=-1"`
+
+	// Accepted hits per period for all identifiers of a route and service combined
+	Aggregate Limits `json:"aggregate"`
+
+	// Limits replacing the ones above for requests of a given HTTP method, counted separately
+	Methods map[string]Limits `json:"methods"`
+
+	// Limits replacing the ones above for gRPC requests of a service (package.Service) or method (package.Service/Method), counted separately; no limits leave them unlimited
+	GrpcMethods map[string]Limits `json:"grpc_methods"`
+
+	// If enabled, requests are GraphQL operations, each costing as many hits as estimated by graphql_cost
+	GraphQL bool `json:"graphql" jsonschema:"default=false"`
+
+	// Names of the GraphQL operations counted apart; other operations are counted together
+	GraphQLOperations []string `json:"graphql_operations" jsonschema:"pattern=^[_A-Za-z][_0-9A-Za-z]*$"`
+
+	// Estimated cost of a GraphQL operation: number of fields selected, depth of the selection, or a single hit (none)
+	GraphQLCost string `json:"graphql_cost" jsonschema:"enum=fields,enum=depth,enum=none,default=fields"`
+
+	// Maximum size, in bytes, of the body of a GraphQL request, larger ones being rejected
+	GraphQLMaxBody int64 `json:"graphql_max_body" jsonschema:"minimum=1,default=65536"`
 
 	// Criteria to limit by
 	LimitBy string `json:"limit_by" jsonschema:"enum=ip,enum=header,enum=path,default=ip"` // TODO consumer, credential, service
@@ -37,34 +70,532 @@ type Config struct {
 	// Path to use when limiting by path
 	Path string `json:"path" jsonschema:"pattern=^/[A-Za-z0-9_.~/%:@!$&'()*+,;=-]*$"` // TODO path validation is more complex (proper percent-encoding, no empty path segments)
 
+	// Request header overriding the limits for the request, as period=hits pairs signed with limits_override_secret
+	LimitsOverrideHeader string `json:"limits_override_header" jsonschema:"pattern=^[A-Za-z0-9_-]+$"`
+
+	// Secret shared with the component setting limits_override_header, which clients must not know
+	LimitsOverrideSecret string `json:"limits_override_secret" jsonschema:"pattern=^.{16,}$"`
+
+	// Property, as a dotted path, overriding the limits for the request, as period=hits pairs
+	LimitsOverrideProperty string `json:"limits_override_property" jsonschema:"pattern=^[A-Za-z0-9_]+(\\.[A-Za-z0-9_]+)*$"`
+
+	// Proxy running the filter, telling where properties are found, or auto to detect it
+	Host string `json:"host" jsonschema:"enum=auto,enum=kong,enum=envoy,default=auto"`
+
+	// Requests sharing counters: all, those of a service, of a route, or of this filter configuration
+	Scope string `json:"scope" jsonschema:"enum=global,enum=service,enum=route,enum=filter_instance,default=route"`
+
+	// Namespace of the counters, separating filters limiting the same routes and services
+	CountersNamespace string `json:"counters_namespace" jsonschema:"pattern=^[A-Za-z0-9_-]{0,32}$"`
+
+	// If enabled, counters start afresh when the limits or the criteria to limit by change
+	ResetCountersOnChange bool `json:"reset_counters_on_change" jsonschema:"default=false"`
+
+	// IANA timezone on which day, month and year windows are aligned
+	Timezone string `json:"timezone" jsonschema:"default=UTC"`
+
 	// Policy to adopt for counters
-	Policy string `json:"policy" jsonschema:"enum=local,default=local"` // TODO cluster, redis
+	Policy string `json:"policy" jsonschema:"enum=local,enum=cluster,default=local"` // TODO redis
+
+	// Upstream, as host:port, with which counters are synchronized under the cluster policy
+	SyncUpstream string `json:"sync_upstream"`
+
+	// Path of the synchronization endpoint on the upstream
+	SyncPath string `json:"sync_path" jsonschema:"pattern=^/[A-Za-z0-9_.~/%:@!$&'()*+,;=-]*$,default=/sync"`
+
+	// Period, in milliseconds, at which counters are synchronized
+	SyncPeriod int64 `json:"sync_period" jsonschema:"minimum=100,default=1000"`
+
+	// Timeout, in milliseconds, of a synchronization call
+	SyncTimeout int64 `json:"sync_timeout" jsonschema:"minimum=1,default=500"`
+
+	// Period, in milliseconds, at which hits are flushed to the store in batches, or 0 to write them on every request
+	FlushPeriod int64 `json:"flush_period" jsonschema:"minimum=0,default=0"`
 
 	// If counter cannot be determined, accept (true) or reject (false) request
 	FaultTolerant bool `json:"fault_tolerant" jsonschema:"default=true"`
 
+	// If the counter store is full, accept (fail_open) or reject (fail_closed) uncounted requests
+	StoreFullPolicy string `json:"store_full_policy" jsonschema:"enum=fail_open,enum=fail_closed,default=fail_open"`
+
+	// Number of keys holding the counters of identifiers, 4 identifiers per key with the least recently counted evicted, or 0 for one key per identifier
+	CounterSlots int64 `json:"counter_slots" jsonschema:"minimum=0,default=0"`
+
+	// Status code of the response rejecting requests when counters are unavailable
+	FailureCode int64 `json:"failure_code" jsonschema:"minimum=500,maximum=599,default=503"`
+
+	// Body of the response rejecting requests when counters are unavailable
+	FailureMessage string `json:"failure_message" jsonschema:"default=Go informs: rate limiting counters unavailable"`
+
 	// If enabled, does not return rate limit counter information in response headers
 	HideClientHeaders bool `json:"hide_client_headers" jsonschema:"default=false"`
+
+	// Format of the Retry-After header: seconds until reset (delta-seconds) or an HTTP-date
+	RetryAfterFormat string `json:"retry_after_format" jsonschema:"enum=delta-seconds,enum=http-date,default=delta-seconds"`
+
+	// Upper bound, in seconds, of the random jitter added to Retry-After
+	RetryAfterJitter int64 `json:"retry_after_jitter" jsonschema:"minimum=0,default=0"`
+
+	// Reply to gRPC requests with a gRPC status rather than an HTTP status: when their content type is gRPC (auto), or never (off)
+	GrpcMode string `json:"grpc_mode" jsonschema:"enum=auto,enum=off,default=auto"`
+
+	// If enabled, requests exceeding the limit are delayed until the window resets instead of rejected
+	Throttle bool `json:"throttle" jsonschema:"default=false"`
+
+	// Maximum number of delayed requests per identifier when throttling
+	ThrottleMaxQueue int64 `json:"throttle_max_queue" jsonschema:"minimum=1,default=10"`
+
+	// Maximum delay, in seconds, of a request when throttling
+	ThrottleMaxDelay int64 `json:"throttle_max_delay" jsonschema:"minimum=1,default=5"`
+
+	// Maximum number of hits over the limit, counting those of delayed requests, up to which requests are delayed when throttling
+	ThrottleMargin int64 `json:"throttle_margin" jsonschema:"minimum=1,default=5"`
+
+	// Problems found while loading which did not prevent it
+	warnings []string
+}
+
+// Limits holds accepted hits per period, -1 leaving the period unlimited
+type Limits struct {
+	Second int64 `json:"second" jsonschema:"minimum=-1"`
+	Minute int64 `json:"minute" jsonschema:"minimum=-1"`
+	Hour   int64 `json:"hour" jsonschema:"minimum=-1"`
+	Day    int64 `json:"day" jsonschema:"minimum=-1"`
+	Month  int64 `json:"month" jsonschema:"minimum=-1"`
+	Year   int64 `json:"year" jsonschema:"minimum=-1"`
+}
+
+var unlimited = Limits{-1, -1, -1, -1, -1, -1}
+
+func (l *Limits) decodeField(d *decoder, key string) (bool, error) {
+	switch key {
+	case "second":
+		return true, d.int64Value(&l.Second)
+	case "minute":
+		return true, d.int64Value(&l.Minute)
+	case "hour":
+		return true, d.int64Value(&l.Hour)
+	case "day":
+		return true, d.int64Value(&l.Day)
+	case "month":
+		return true, d.int64Value(&l.Month)
+	case "year":
+		return true, d.int64Value(&l.Year)
+	}
+	return false, nil
+}
+
+func (conf *Config) decodeField(d *decoder, key string) (bool, error) {
+	switch key {
+	case "strict":
+		return true, d.boolValue(&conf.Strict)
+	case "second":
+		return true, d.int64Value(&conf.Second)
+	case "minute":
+		return true, d.int64Value(&conf.Minute)
+	case "hour":
+		return true, d.int64Value(&conf.Hour)
+	case "day":
+		return true, d.int64Value(&conf.Day)
+	case "month":
+		return true, d.int64Value(&conf.Month)
+	case "year":
+		return true, d.int64Value(&conf.Year)
+	case "protocol":
+		return true, d.stringValue(&conf.Protocol)
+	case "max_connections":
+		return true, d.int64Value(&conf.MaxConnections)
+	case "aggregate":
+		return true, d.objectValue(func(key string) (bool, error) {
+			return conf.Aggregate.decodeField(d, key)
+		})
+	case "methods":
+		return true, d.objectValue(func(method string) (bool, error) {
+			if conf.Methods == nil {
+				conf.Methods = make(map[string]Limits)
+			}
+			l := unlimited
+			err := d.objectValue(func(key string) (bool, error) {
+				return l.decodeField(d, key)
+			})
+			conf.Methods[method] = l
+			return true, err
+		})
+	case "grpc_methods":
+		return true, d.objectValue(func(name string) (bool, error) {
+			if conf.GrpcMethods == nil {
+				conf.GrpcMethods = make(map[string]Limits)
+			}
+			l := unlimited
+			err := d.objectValue(func(key string) (bool, error) {
+				return l.decodeField(d, key)
+			})
+			conf.GrpcMethods[name] = l
+			return true, err
+		})
+	case "graphql":
+		return true, d.boolValue(&conf.GraphQL)
+	case "graphql_operations":
+		conf.GraphQLOperations = nil
+		return true, d.arrayValue(func() error {
+			var name string
+			err := d.stringValue(&name)
+			conf.GraphQLOperations = append(conf.GraphQLOperations, name)
+			return err
+		})
+	case "graphql_cost":
+		return true, d.stringValue(&conf.GraphQLCost)
+	case "graphql_max_body":
+		return true, d.int64Value(&conf.GraphQLMaxBody)
+	case "limit_by":
+		return true, d.stringValue(&conf.LimitBy)
+	case "header_name":
+		return true, d.stringValue(&conf.HeaderName)
+	case "path":
+		return true, d.stringValue(&conf.Path)
+	case "limits_override_header":
+		return true, d.stringValue(&conf.LimitsOverrideHeader)
+	case "limits_override_secret":
+		return true, d.stringValue(&conf.LimitsOverrideSecret)
+	case "limits_override_property":
+		return true, d.stringValue(&conf.LimitsOverrideProperty)
+	case "host":
+		return true, d.stringValue(&conf.Host)
+	case "scope":
+		return true, d.stringValue(&conf.Scope)
+	case "counters_namespace":
+		return true, d.stringValue(&conf.CountersNamespace)
+	case "reset_counters_on_change":
+		return true, d.boolValue(&conf.ResetCountersOnChange)
+	case "timezone":
+		return true, d.stringValue(&conf.Timezone)
+	case "policy":
+		return true, d.stringValue(&conf.Policy)
+	case "sync_upstream":
+		return true, d.stringValue(&conf.SyncUpstream)
+	case "sync_path":
+		return true, d.stringValue(&conf.SyncPath)
+	case "sync_period":
+		return true, d.int64Value(&conf.SyncPeriod)
+	case "sync_timeout":
+		return true, d.int64Value(&conf.SyncTimeout)
+	case "flush_period":
+		return true, d.int64Value(&conf.FlushPeriod)
+	case "fault_tolerant":
+		return true, d.boolValue(&conf.FaultTolerant)
+	case "store_full_policy":
+		return true, d.stringValue(&conf.StoreFullPolicy)
+	case "counter_slots":
+		return true, d.int64Value(&conf.CounterSlots)
+	case "failure_code":
+		return true, d.int64Value(&conf.FailureCode)
+	case "failure_message":
+		return true, d.stringValue(&conf.FailureMessage)
+	case "hide_client_headers":
+		return true, d.boolValue(&conf.HideClientHeaders)
+	case "retry_after_format":
+		return true, d.stringValue(&conf.RetryAfterFormat)
+	case "retry_after_jitter":
+		return true, d.int64Value(&conf.RetryAfterJitter)
+	case "grpc_mode":
+		return true, d.stringValue(&conf.GrpcMode)
+	case "throttle":
+		return true, d.boolValue(&conf.Throttle)
+	case "throttle_max_queue":
+		return true, d.int64Value(&conf.ThrottleMaxQueue)
+	case "throttle_max_delay":
+		return true, d.int64Value(&conf.ThrottleMaxDelay)
+	case "throttle_margin":
+		return true, d.int64Value(&conf.ThrottleMargin)
+	}
+	return false, nil
+}
+
+// Warnings returns the problems found by Load which did not make it fail,
+// such as unknown fields when not in strict mode.
+func (conf *Config) Warnings() []string {
+	return conf.warnings
 }
 
 func Load(data []byte, conf *Config) error {
 	// set defaults
+	conf.Strict = true
 	conf.Second = -1
 	conf.Minute = -1
 	conf.Hour = -1
 	conf.Day = -1
 	conf.Month = -1
 	conf.Year = -1
+	conf.Protocol = "http"
+	conf.MaxConnections = -1
+	conf.Aggregate = unlimited
+	conf.Methods = nil
+	conf.GrpcMethods = nil
+	conf.GraphQL = false
+	conf.GraphQLOperations = nil
+	conf.GraphQLCost = "fields"
+	conf.GraphQLMaxBody = 65536
 	conf.LimitBy = "ip"
 	conf.Policy = "local"
+	conf.SyncPath = "/sync"
+	conf.SyncPeriod = 1000
+	conf.SyncTimeout = 500
+	conf.Timezone = "UTC"
+	conf.Host = "auto"
+	conf.Scope = "route"
+	conf.CountersNamespace = ""
+	conf.ResetCountersOnChange = false
+	conf.FlushPeriod = 0
 	conf.FaultTolerant = true
+	conf.StoreFullPolicy = "fail_open"
+	conf.CounterSlots = 0
+	conf.FailureCode = 503
+	conf.FailureMessage = "Go informs: rate limiting counters unavailable"
 	conf.HideClientHeaders = false
+	conf.RetryAfterFormat = "delta-seconds"
+	conf.RetryAfterJitter = 0
+	conf.GrpcMode = "auto"
+	conf.Throttle = false
+	conf.ThrottleMaxQueue = 10
+	conf.ThrottleMaxDelay = 5
+	conf.ThrottleMargin = 5
+
+	conf.warnings = nil
 
 	// load configuration
-	err := ffjson.Unmarshal(data, conf)
+	unknown, err := decode(data, conf.decodeField)
 	if err != nil {
 		return err
 	}
 
+	if len(unknown) > 0 {
+		errs := ValidationError{}
+		for _, u := range unknown {
+			errs = append(errs, u.Error())
+		}
+		if conf.Strict {
+			return errs
+		}
+		conf.warnings = errs
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// Validation
+// -----------------------------------------------------------------------------
+
+// Patterns from rate-limiting.meta.json
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+var pathPattern = regexp.MustCompile(`^/[A-Za-z0-9_.~/%:@!$&'()*+,;=-]*$`)
+var overrideHeaderPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+var overrideSecretPattern = regexp.MustCompile(`^.{16,}$`)
+var methodPattern = regexp.MustCompile(`^[A-Z]+$`)
+var grpcMethodPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*(/[A-Za-z_][A-Za-z0-9_]*)?$`)
+var graphqlNamePattern = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{0,32}$`)
+var propertyPattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// ValidationError lists every problem found in a configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+func checkEnum(errs *ValidationError, field string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	*errs = append(*errs, fmt.Sprintf("%s must be one of %s, got %q",
+		field, strings.Join(allowed, ", "), value))
+}
+
+func checkRange(errs *ValidationError, field string, value int64, min int64, max int64) {
+	if value < min || value > max {
+		*errs = append(*errs, fmt.Sprintf("%s must be between %d and %d, got %d",
+			field, min, max, value))
+	}
+}
+
+// checkLimits reports negative limits, and whether any period is limited
+func checkLimits(errs *ValidationError, prefix string, l Limits) bool {
+	limits := []struct {
+		name  string
+		value int64
+	}{
+		{"second", l.Second},
+		{"minute", l.Minute},
+		{"hour", l.Hour},
+		{"day", l.Day},
+		{"month", l.Month},
+		{"year", l.Year},
+	}
+
+	set := false
+	for _, p := range limits {
+		if p.value == -1 {
+			continue
+		}
+		set = true
+		if p.value < 0 {
+			*errs = append(*errs, fmt.Sprintf("%s%s must be a non-negative number of hits, got %d", prefix, p.name, p.value))
+		}
+	}
+
+	return set
+}
+
+// Validate checks a loaded configuration against the constraints of the
+// schema in rate-limiting.meta.json, as well as those across fields which
+// the schema cannot express, and reports all problems at once.
+func (conf *Config) Validate() error {
+	errs := ValidationError{}
+
+	set := checkLimits(&errs, "", Limits{conf.Second, conf.Minute, conf.Hour, conf.Day, conf.Month, conf.Year})
+	if checkLimits(&errs, "aggregate.", conf.Aggregate) {
+		set = true
+	}
+	for method, l := range conf.Methods {
+		if !methodPattern.MatchString(method) {
+			errs = append(errs, fmt.Sprintf("methods must be keyed by uppercase HTTP methods, got %q", method))
+		}
+		if !checkLimits(&errs, "methods."+method+".", l) {
+			errs = append(errs, fmt.Sprintf("at least one limit must be set for method %s", method))
+		}
+		set = true
+	}
+	for name, l := range conf.GrpcMethods {
+		if !grpcMethodPattern.MatchString(name) {
+			errs = append(errs, fmt.Sprintf("grpc_methods must be keyed by package.Service or package.Service/Method, got %q", name))
+		}
+		// Services and methods without limits are exempted from the others
+		if checkLimits(&errs, "grpc_methods."+name+".", l) {
+			set = true
+		}
+	}
+	if conf.MaxConnections != -1 {
+		set = true
+		if conf.MaxConnections < 0 {
+			errs = append(errs, fmt.Sprintf("max_connections must be a non-negative number of connections, got %d", conf.MaxConnections))
+		}
+	}
+	if !set {
+		errs = append(errs, "at least one of second, minute, hour, day, month or year must be set, per identifier, per method, per gRPC method or in aggregate, or max_connections")
+	}
+
+	checkEnum(&errs, "protocol", conf.Protocol, "http", "tcp")
+	if conf.Protocol == "tcp" && conf.LimitBy != "ip" {
+		errs = append(errs, "limit_by must be ip when protocol is tcp")
+	}
+	if conf.Protocol == "http" && conf.MaxConnections != -1 {
+		errs = append(errs, "max_connections requires protocol to be tcp")
+	}
+
+	checkEnum(&errs, "graphql_cost", conf.GraphQLCost, "fields", "depth", "none")
+	if conf.GraphQL && conf.Protocol == "tcp" {
+		errs = append(errs, "graphql requires protocol to be http")
+	}
+	for _, name := range conf.GraphQLOperations {
+		if !graphqlNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Sprintf("graphql_operations must hold GraphQL operation names, got %q", name))
+		}
+	}
+	if len(conf.GraphQLOperations) > 0 && !conf.GraphQL {
+		errs = append(errs, "graphql_operations requires graphql to be enabled")
+	}
+	if conf.GraphQLMaxBody < 1 {
+		errs = append(errs, fmt.Sprintf("graphql_max_body must be at least 1, got %d", conf.GraphQLMaxBody))
+	}
+
+	checkEnum(&errs, "limit_by", conf.LimitBy, "ip", "header", "path")
+	if conf.LimitBy == "header" && conf.HeaderName == "" {
+		errs = append(errs, "header_name is required when limit_by is header")
+	}
+	if conf.HeaderName != "" && !headerNamePattern.MatchString(conf.HeaderName) {
+		errs = append(errs, fmt.Sprintf("header_name must match %s, got %q", headerNamePattern, conf.HeaderName))
+	}
+	if conf.LimitBy == "path" && conf.Path == "" {
+		errs = append(errs, "path is required when limit_by is path")
+	}
+	if conf.Path != "" && !pathPattern.MatchString(conf.Path) {
+		errs = append(errs, fmt.Sprintf("path must match %s, got %q", pathPattern, conf.Path))
+	}
+
+	if conf.LimitsOverrideHeader != "" && !overrideHeaderPattern.MatchString(conf.LimitsOverrideHeader) {
+		errs = append(errs, fmt.Sprintf("limits_override_header must match %s, got %q", overrideHeaderPattern, conf.LimitsOverrideHeader))
+	}
+	// Clients can send the header themselves: only signed values are trusted
+	if conf.LimitsOverrideHeader != "" && conf.LimitsOverrideSecret == "" {
+		errs = append(errs, "limits_override_secret is required when limits_override_header is set")
+	}
+	if conf.LimitsOverrideSecret != "" && !overrideSecretPattern.MatchString(conf.LimitsOverrideSecret) {
+		errs = append(errs, "limits_override_secret must be at least 16 characters long")
+	}
+	if conf.LimitsOverrideProperty != "" && !propertyPattern.MatchString(conf.LimitsOverrideProperty) {
+		errs = append(errs, fmt.Sprintf("limits_override_property must match %s, got %q", propertyPattern, conf.LimitsOverrideProperty))
+	}
+
+	checkEnum(&errs, "host", conf.Host, "auto", "kong", "envoy")
+	checkEnum(&errs, "scope", conf.Scope, "global", "service", "route", "filter_instance")
+	if !namespacePattern.MatchString(conf.CountersNamespace) {
+		errs = append(errs, fmt.Sprintf("counters_namespace must match %s, got %q", namespacePattern, conf.CountersNamespace))
+	}
+
+	checkEnum(&errs, "policy", conf.Policy, "local", "cluster")
+	if conf.Policy == "cluster" {
+		if conf.SyncUpstream == "" {
+			errs = append(errs, "sync_upstream is required when policy is cluster")
+		}
+		if !pathPattern.MatchString(conf.SyncPath) {
+			errs = append(errs, fmt.Sprintf("sync_path must match %s, got %q", pathPattern, conf.SyncPath))
+		}
+		if conf.SyncPeriod < 100 {
+			errs = append(errs, fmt.Sprintf("sync_period must be at least 100, got %d", conf.SyncPeriod))
+		}
+		if conf.SyncTimeout < 1 {
+			errs = append(errs, fmt.Sprintf("sync_timeout must be at least 1, got %d", conf.SyncTimeout))
+		}
+	}
+	if _, err := time.LoadLocation(conf.Timezone); err != nil {
+		errs = append(errs, fmt.Sprintf("timezone must be an IANA timezone name, got %q", conf.Timezone))
+	}
+
+	if conf.FlushPeriod < 0 {
+		errs = append(errs, fmt.Sprintf("flush_period must not be negative, got %d", conf.FlushPeriod))
+	}
+
+	checkEnum(&errs, "store_full_policy", conf.StoreFullPolicy, "fail_open", "fail_closed")
+	if conf.CounterSlots < 0 {
+		errs = append(errs, fmt.Sprintf("counter_slots must not be negative, got %d", conf.CounterSlots))
+	}
+	checkRange(&errs, "failure_code", conf.FailureCode, 500, 599)
+
+	checkEnum(&errs, "retry_after_format", conf.RetryAfterFormat, "delta-seconds", "http-date")
+	if conf.RetryAfterJitter < 0 {
+		errs = append(errs, fmt.Sprintf("retry_after_jitter must not be negative, got %d", conf.RetryAfterJitter))
+	}
+
+	checkEnum(&errs, "grpc_mode", conf.GrpcMode, "auto", "off")
+
+	if conf.Throttle {
+		if conf.ThrottleMaxQueue < 1 {
+			errs = append(errs, fmt.Sprintf("throttle_max_queue must be at least 1, got %d", conf.ThrottleMaxQueue))
+		}
+		if conf.ThrottleMaxDelay < 1 {
+			errs = append(errs, fmt.Sprintf("throttle_max_delay must be at least 1, got %d", conf.ThrottleMaxDelay))
+		}
+		if conf.ThrottleMargin < 1 {
+			errs = append(errs, fmt.Sprintf("throttle_margin must be at least 1, got %d", conf.ThrottleMargin))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
 	return nil
 }
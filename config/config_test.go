@@ -0,0 +1,157 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	var conf Config
+	if err := Load([]byte(`{}`), &conf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, limit := range map[string]int64{
+		"second": conf.Second,
+		"minute": conf.Minute,
+		"hour":   conf.Hour,
+		"day":    conf.Day,
+		"month":  conf.Month,
+		"year":   conf.Year,
+	} {
+		if limit != -1 {
+			t.Errorf("expected %s to default to -1, got %d", name, limit)
+		}
+	}
+	if conf.LimitBy != "ip" {
+		t.Errorf("expected limit_by to default to ip, got %q", conf.LimitBy)
+	}
+	if conf.Policy != "local" {
+		t.Errorf("expected policy to default to local, got %q", conf.Policy)
+	}
+	if !conf.FaultTolerant {
+		t.Errorf("expected fault_tolerant to default to true")
+	}
+	if conf.FailureCode != 503 {
+		t.Errorf("expected failure_code to default to 503, got %d", conf.FailureCode)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	var conf Config
+	data := `{"minute": 10, "limit_by": "header", "header_name": "x_consumer", "fault_tolerant": false}`
+	if err := Load([]byte(data), &conf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if conf.Minute != 10 {
+		t.Errorf("expected minute to be 10, got %d", conf.Minute)
+	}
+	if conf.Second != -1 {
+		t.Errorf("expected second to keep its default, got %d", conf.Second)
+	}
+	if conf.LimitBy != "header" || conf.HeaderName != "x_consumer" {
+		t.Errorf("expected to limit by header x_consumer, got %q %q", conf.LimitBy, conf.HeaderName)
+	}
+	if conf.FaultTolerant {
+		t.Errorf("expected fault_tolerant to be false")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	var conf Config
+	if err := Load([]byte(`{"minute": "ten"}`), &conf); err == nil {
+		t.Errorf("expected an error for a non-integer limit")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		problems []string
+	}{
+		{"valid", `{"minute": 10}`, nil},
+		{"valid by header", `{"minute": 10, "limit_by": "header", "header_name": "x_consumer"}`, nil},
+		{"valid by path", `{"minute": 10, "limit_by": "path", "path": "/api/v1"}`, nil},
+		{"valid zero limit", `{"minute": 0}`, nil},
+		{"valid aggregate only", `{"aggregate": {"minute": 100}}`, nil},
+		{"no limits", `{}`, []string{"at least one of"}},
+		{"valid max connections only", `{"protocol": "tcp", "max_connections": 10}`, nil},
+		{"negative max connections", `{"protocol": "tcp", "max_connections": -5}`, []string{"max_connections must be"}},
+		{"max connections over http", `{"max_connections": 10}`, []string{"max_connections requires protocol to be tcp"}},
+		{"tcp by header", `{"minute": 1, "protocol": "tcp", "limit_by": "header", "header_name": "x_consumer"}`, []string{"limit_by must be ip"}},
+		{"no limits in aggregate", `{"aggregate": {}}`, []string{"at least one of"}},
+		{"valid methods only", `{"methods": {"POST": {"minute": 10}, "GET": {"minute": 600}}}`, nil},
+		{"no limits for method", `{"minute": 1, "methods": {"POST": {}}}`, []string{"at least one limit must be set for method POST"}},
+		{"lowercase method", `{"methods": {"post": {"minute": 1}}}`, []string{"uppercase HTTP methods"}},
+		{"negative method limit", `{"methods": {"POST": {"minute": -2}}}`, []string{"methods.POST.minute must be a non-negative"}},
+		{"valid grpc methods", `{"minute": 10, "grpc_methods": {"chat.v1.Chat/Stream": {"minute": 1}, "grpc.health.v1.Health": {}}}`, nil},
+		{"unlimited grpc methods only", `{"grpc_methods": {"grpc.health.v1.Health": {}}}`, []string{"at least one of"}},
+		{"grpc method pattern", `{"minute": 1, "grpc_methods": {"/chat.v1.Chat/Stream": {"minute": 1}}}`, []string{"grpc_methods must be keyed by"}},
+		{"negative grpc method limit", `{"grpc_methods": {"chat.v1.Chat": {"hour": -2}}}`, []string{"grpc_methods.chat.v1.Chat.hour must be a non-negative"}},
+		{"valid graphql", `{"minute": 100, "graphql": true, "graphql_cost": "depth"}`, nil},
+		{"unknown graphql cost", `{"minute": 100, "graphql": true, "graphql_cost": "complexity"}`, []string{"graphql_cost must be one of"}},
+		{"graphql over tcp", `{"minute": 100, "protocol": "tcp", "graphql": true}`, []string{"graphql requires protocol to be http"}},
+		{"graphql operations", `{"minute": 100, "graphql": true, "graphql_operations": ["Me", "search_2"]}`, nil},
+		{"graphql operation name", `{"minute": 100, "graphql": true, "graphql_operations": ["Me", "2fa"]}`, []string{"graphql_operations must hold GraphQL operation names"}},
+		{"graphql operations without graphql", `{"minute": 100, "graphql_operations": ["Me"]}`, []string{"graphql_operations requires graphql to be enabled"}},
+		{"graphql max body", `{"minute": 100, "graphql": true, "graphql_max_body": 0}`, []string{"graphql_max_body must be at least 1"}},
+		{"negative limit", `{"minute": -2}`, []string{"minute must be a non-negative"}},
+		{"negative aggregate limit", `{"minute": 1, "aggregate": {"hour": -2}}`, []string{"aggregate.hour must be a non-negative"}},
+		{"header without name", `{"minute": 1, "limit_by": "header"}`, []string{"header_name is required"}},
+		{"path without path", `{"minute": 1, "limit_by": "path"}`, []string{"path is required"}},
+		{"header name pattern", `{"minute": 1, "limit_by": "header", "header_name": "x consumer"}`, []string{"header_name must match"}},
+		{"path pattern", `{"minute": 1, "limit_by": "path", "path": "api"}`, []string{"path must match"}},
+		{"valid override header", `{"minute": 1, "limits_override_header": "X-Plan", "limits_override_secret": "0123456789abcdef"}`, nil},
+		{"override header without secret", `{"minute": 1, "limits_override_header": "X-Plan"}`, []string{"limits_override_secret is required"}},
+		{"short override secret", `{"minute": 1, "limits_override_header": "X-Plan", "limits_override_secret": "secret"}`, []string{"at least 16 characters"}},
+		{"unknown limit_by", `{"minute": 1, "limit_by": "consumer"}`, []string{"limit_by must be one of"}},
+		{"unknown policy", `{"minute": 1, "policy": "redis"}`, []string{"policy must be one of"}},
+		{"valid cluster", `{"minute": 1, "policy": "cluster", "sync_upstream": "sync.internal:8080"}`, nil},
+		{"cluster without upstream", `{"minute": 1, "policy": "cluster"}`, []string{"sync_upstream is required"}},
+		{"cluster sync period", `{"minute": 1, "policy": "cluster", "sync_upstream": "sync:80", "sync_period": 10}`, []string{"sync_period must be at least"}},
+		{"unknown host", `{"minute": 1, "host": "nginx"}`, []string{"host must be one of"}},
+		{"unknown scope", `{"minute": 1, "scope": "consumer"}`, []string{"scope must be one of"}},
+		{"counters namespace", `{"minute": 1, "counters_namespace": "edge:1"}`, []string{"counters_namespace must match"}},
+		{"unknown timezone", `{"minute": 1, "timezone": "Mars/Olympus_Mons"}`, []string{"timezone must be"}},
+		{"flush period", `{"minute": 1, "flush_period": -1}`, []string{"flush_period must not be negative"}},
+		{"counter slots", `{"minute": 1, "counter_slots": -1}`, []string{"counter_slots must not be negative"}},
+		{"failure code", `{"minute": 1, "failure_code": 429}`, []string{"failure_code must be between"}},
+		{"unknown grpc mode", `{"minute": 1, "grpc_mode": "always"}`, []string{"grpc_mode must be one of"}},
+		{"throttle queue", `{"minute": 1, "throttle": true, "throttle_max_queue": 0}`, []string{"throttle_max_queue"}},
+		{
+			"every problem",
+			`{"second": -5, "limit_by": "header", "policy": "redis", "retry_after_format": "date"}`,
+			[]string{"second must be", "header_name is required", "policy must be", "retry_after_format must be"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var conf Config
+			if err := Load([]byte(tc.data), &conf); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err := conf.Validate()
+			if len(tc.problems) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			errs, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("expected a ValidationError, got %v", err)
+			}
+			if len(errs) != len(tc.problems) {
+				t.Errorf("expected %d problems, got %d: %v", len(tc.problems), len(errs), err)
+			}
+			for _, p := range tc.problems {
+				if !strings.Contains(err.Error(), p) {
+					t.Errorf("expected error to contain %q, got %v", p, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,424 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// -----------------------------------------------------------------------------
+// Decoder
+// -----------------------------------------------------------------------------
+
+// The configuration is decoded by a small hand-written JSON parser which
+// assigns values directly to Config fields: no reflection, no intermediate
+// tree, and allocations only for strings and error messages. This keeps it
+// working under TinyGo, and lets it report where problems are.
+
+// DecodeError is a problem found at a given place of the document
+type DecodeError struct {
+	Line   int
+	Column int
+	Field  string // dotted path of the field, empty at the top level
+	Msg    string
+}
+
+func (e *DecodeError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("line %d, column %d: %s: %s", e.Line, e.Column, e.Field, e.Msg)
+}
+
+type decoder struct {
+	data    []byte
+	pos     int
+	path    []string
+	unknown []*DecodeError
+}
+
+func (d *decoder) errorAt(pos int, format string, args ...interface{}) *DecodeError {
+	line, col := 1, 1
+	for _, c := range d.data[:pos] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+
+	return &DecodeError{
+		Line:   line,
+		Column: col,
+		Field:  strings.Join(d.path, "."),
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+func (d *decoder) skipSpace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next significant byte, or 0 at the end of the document
+func (d *decoder) peek() byte {
+	d.skipSpace()
+	if d.pos >= len(d.data) {
+		return 0
+	}
+	return d.data[d.pos]
+}
+
+func (d *decoder) expect(c byte) error {
+	if d.peek() != c {
+		return d.unexpected()
+	}
+	d.pos++
+	return nil
+}
+
+func (d *decoder) unexpected() error {
+	if d.pos >= len(d.data) {
+		return d.errorAt(d.pos, "unexpected end of document")
+	}
+	r, _ := utf8.DecodeRune(d.data[d.pos:])
+	return d.errorAt(d.pos, "unexpected character %q", r)
+}
+
+func (d *decoder) literal(lit string) bool {
+	end := d.pos + len(lit)
+	if end <= len(d.data) && string(d.data[d.pos:end]) == lit {
+		d.pos = end
+		return true
+	}
+	return false
+}
+
+// null consumes a null value, if any. A null field keeps its default value.
+func (d *decoder) null() bool {
+	return d.peek() == 'n' && d.literal("null")
+}
+
+// object decodes an object, calling field for each key with the decoder
+// positioned on its value. The callback returns false for unknown keys,
+// whose values are then skipped and recorded.
+func (d *decoder) object(field func(key string) (bool, error)) error {
+	if err := d.expect('{'); err != nil {
+		return d.errorAt(d.pos, "expected an object")
+	}
+
+	if d.peek() == '}' {
+		d.pos++
+		return nil
+	}
+
+	for {
+		if d.peek() != '"' {
+			return d.unexpected()
+		}
+		start := d.pos
+		key, err := d.rawString()
+		if err != nil {
+			return err
+		}
+		if err := d.expect(':'); err != nil {
+			return err
+		}
+
+		d.path = append(d.path, key)
+		known, err := field(key)
+		if err == nil && !known {
+			d.unknown = append(d.unknown, d.errorAt(start, "unknown field"))
+			err = d.skip()
+		}
+		d.path = d.path[:len(d.path)-1]
+		if err != nil {
+			return err
+		}
+
+		switch d.peek() {
+		case ',':
+			d.pos++
+		case '}':
+			d.pos++
+			return nil
+		default:
+			return d.unexpected()
+		}
+	}
+}
+
+func (d *decoder) array(item func() error) error {
+	if err := d.expect('['); err != nil {
+		return d.errorAt(d.pos, "expected an array")
+	}
+
+	if d.peek() == ']' {
+		d.pos++
+		return nil
+	}
+
+	for {
+		if err := item(); err != nil {
+			return err
+		}
+
+		switch d.peek() {
+		case ',':
+			d.pos++
+		case ']':
+			d.pos++
+			return nil
+		default:
+			return d.unexpected()
+		}
+	}
+}
+
+func (d *decoder) rawString() (string, error) {
+	start := d.pos
+	d.pos++ // opening quote
+
+	// Fast path: no escapes, a single allocation for the result
+	i := d.pos
+	for i < len(d.data) && d.data[i] != '"' && d.data[i] != '\\' && d.data[i] >= 0x20 {
+		i++
+	}
+	if i < len(d.data) && d.data[i] == '"' {
+		s := string(d.data[d.pos:i])
+		d.pos = i + 1
+		return s, nil
+	}
+
+	var sb strings.Builder
+	sb.Write(d.data[d.pos:i])
+	d.pos = i
+
+	for d.pos < len(d.data) {
+		c := d.data[d.pos]
+		switch {
+		case c == '"':
+			d.pos++
+			return sb.String(), nil
+		case c < 0x20:
+			return "", d.errorAt(d.pos, "control character in string")
+		case c != '\\':
+			sb.WriteByte(c)
+			d.pos++
+			continue
+		}
+
+		d.pos++
+		if d.pos >= len(d.data) {
+			break
+		}
+		switch d.data[d.pos] {
+		case '"', '\\', '/':
+			sb.WriteByte(d.data[d.pos])
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'u':
+			r, err := d.unicodeEscape()
+			if err != nil {
+				return "", err
+			}
+			sb.WriteRune(r)
+			continue
+		default:
+			return "", d.errorAt(d.pos-1, "invalid escape sequence")
+		}
+		d.pos++
+	}
+
+	return "", d.errorAt(start, "unterminated string")
+}
+
+func (d *decoder) hex4() (rune, error) {
+	if d.pos+4 > len(d.data) {
+		return 0, d.errorAt(d.pos, "invalid unicode escape")
+	}
+	n, err := strconv.ParseUint(string(d.data[d.pos:d.pos+4]), 16, 16)
+	if err != nil {
+		return 0, d.errorAt(d.pos, "invalid unicode escape")
+	}
+	d.pos += 4
+	return rune(n), nil
+}
+
+// unicodeEscape decodes \uXXXX, positioned on the 'u', including
+// surrogate pairs
+func (d *decoder) unicodeEscape() (rune, error) {
+	d.pos++
+	r, err := d.hex4()
+	if err != nil {
+		return 0, err
+	}
+	if r < 0xd800 || r > 0xdbff {
+		return r, nil
+	}
+
+	if !d.literal("\\u") {
+		return utf8.RuneError, nil
+	}
+	r2, err := d.hex4()
+	if err != nil {
+		return 0, err
+	}
+	if r2 < 0xdc00 || r2 > 0xdfff {
+		return utf8.RuneError, nil
+	}
+	return (r-0xd800)<<10 + (r2 - 0xdc00) + 0x10000, nil
+}
+
+func (d *decoder) rawNumber() (string, error) {
+	start := d.pos
+	for d.pos < len(d.data) {
+		c := d.data[d.pos]
+		if (c >= '0' && c <= '9') || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E' {
+			d.pos++
+		} else {
+			break
+		}
+	}
+	if start == d.pos {
+		return "", d.unexpected()
+	}
+	return string(d.data[start:d.pos]), nil
+}
+
+// skip consumes a value of any type
+func (d *decoder) skip() error {
+	switch c := d.peek(); {
+	case c == '{':
+		return d.object(func(string) (bool, error) { return true, d.skip() })
+	case c == '[':
+		return d.array(d.skip)
+	case c == '"':
+		_, err := d.rawString()
+		return err
+	case c == 't' && d.literal("true"), c == 'f' && d.literal("false"), c == 'n' && d.literal("null"):
+		return nil
+	default:
+		_, err := d.rawNumber()
+		return err
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Typed values
+// -----------------------------------------------------------------------------
+
+func (d *decoder) stringValue(v *string) error {
+	if d.null() {
+		return nil
+	}
+	if d.peek() != '"' {
+		return d.errorAt(d.pos, "expected a string")
+	}
+	s, err := d.rawString()
+	if err != nil {
+		return err
+	}
+	*v = s
+	return nil
+}
+
+func (d *decoder) boolValue(v *bool) error {
+	if d.null() {
+		return nil
+	}
+	d.skipSpace()
+	switch {
+	case d.literal("true"):
+		*v = true
+	case d.literal("false"):
+		*v = false
+	default:
+		return d.errorAt(d.pos, "expected a boolean")
+	}
+	return nil
+}
+
+func (d *decoder) int64Value(v *int64) error {
+	if d.null() {
+		return nil
+	}
+	start := d.pos
+	c := d.peek()
+	if c != '-' && (c < '0' || c > '9') {
+		return d.errorAt(d.pos, "expected an integer")
+	}
+	s, err := d.rawNumber()
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// Integral values may still be written as 1e3 or 10.0
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil || f != float64(int64(f)) {
+			return d.errorAt(start, "expected an integer, got %s", s)
+		}
+		n = int64(f)
+	}
+	*v = n
+	return nil
+}
+
+// objectValue decodes a nested object: see object
+func (d *decoder) objectValue(field func(key string) (bool, error)) error {
+	if d.null() {
+		return nil
+	}
+	return d.object(field)
+}
+
+// arrayValue decodes an array, calling item for each element with the
+// decoder positioned on it
+func (d *decoder) arrayValue(item func() error) error {
+	if d.null() {
+		return nil
+	}
+	return d.array(item)
+}
+
+// decode parses a whole document, which must be an object, and returns the
+// unknown fields found in it
+func decode(data []byte, field func(d *decoder, key string) (bool, error)) ([]*DecodeError, error) {
+	d := &decoder{data: data}
+
+	// No configuration at all leaves every default in place
+	if d.peek() == 0 {
+		return nil, nil
+	}
+
+	err := d.object(func(key string) (bool, error) {
+		return field(d, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if d.peek() != 0 {
+		return nil, d.errorAt(d.pos, "unexpected data after the configuration")
+	}
+
+	return d.unknown, nil
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadUnknownField(t *testing.T) {
+	var conf Config
+	err := Load([]byte(`{"minutes": 10}`), &conf)
+	if err == nil {
+		t.Fatalf("expected unknown field to be rejected")
+	}
+	if !strings.Contains(err.Error(), "line 1, column 2: minutes: unknown field") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadUnknownFieldNotStrict(t *testing.T) {
+	var conf Config
+	err := Load([]byte(`{"strict": false, "minutes": 10, "minute": 5}`), &conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conf.Minute != 5 {
+		t.Errorf("expected minute to be 5, got %d", conf.Minute)
+	}
+
+	warnings := conf.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "minutes: unknown field") {
+		t.Errorf("expected a warning for the unknown field, got %v", warnings)
+	}
+}
+
+func TestLoadUnknownNestedField(t *testing.T) {
+	var conf Config
+	err := Load([]byte(`{"second": 1, "extra": {"a": [1, {"b": null}], "c": "\"}"}, "other": true}`), &conf)
+	if err == nil {
+		t.Fatalf("expected unknown fields to be rejected")
+	}
+
+	errs, ok := err.(ValidationError)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected both unknown fields to be listed, got %v", err)
+	}
+	if !strings.Contains(errs[0], "extra: unknown field") || !strings.Contains(errs[1], "other: unknown field") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadErrorPosition(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		err  string
+	}{
+		{"{\n  \"minute\": \"ten\"\n}", "line 2, column 13: minute: expected an integer"},
+		{"{\n  \"minute\": 1.5\n}", "line 2, column 13: minute: expected an integer, got 1.5"},
+		{"{\"hide_client_headers\": 1}", "line 1, column 25: hide_client_headers: expected a boolean"},
+		{"{\"policy\": local}", "line 1, column 12: policy: expected a string"},
+		{"{\"minute\": 1 \"hour\": 2}", "line 1, column 14: unexpected character '\"'"},
+		{"{\"minute\": 1", "line 1, column 13: unexpected end of document"},
+		{"{\"minute\": 1} {}", "line 1, column 15: unexpected data after the configuration"},
+		{"[]", "line 1, column 1: expected an object"},
+		{"{\"path\": \"/a\\x\"}", "line 1, column 13: path: invalid escape sequence"},
+	} {
+		var conf Config
+		err := Load([]byte(tc.data), &conf)
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.data)
+		} else if err.Error() != tc.err {
+			t.Errorf("%s: expected %q, got %q", tc.data, tc.err, err)
+		}
+	}
+}
+
+func TestLoadValues(t *testing.T) {
+	var conf Config
+	data := `{
+		"minute": 1e3,
+		"hour": -1,
+		"day": null,
+		"limit_by": "path",
+		"path": "/café/😀\/x",
+		"failure_message": "tab\there \"quoted\""
+	}`
+	if err := Load([]byte(data), &conf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if conf.Minute != 1000 {
+		t.Errorf("expected minute to be 1000, got %d", conf.Minute)
+	}
+	if conf.Day != -1 {
+		t.Errorf("expected null day to keep its default, got %d", conf.Day)
+	}
+	if conf.Path != "/café/😀/x" {
+		t.Errorf("unexpected path %q", conf.Path)
+	}
+	if conf.FailureMessage != "tab\there \"quoted\"" {
+		t.Errorf("unexpected failure_message %q", conf.FailureMessage)
+	}
+}
+
+func TestLoadEmpty(t *testing.T) {
+	var conf Config
+	if err := Load(nil, &conf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conf.LimitBy != "ip" {
+		t.Errorf("expected defaults, got limit_by %q", conf.LimitBy)
+	}
+}
+
+func TestDecodeNested(t *testing.T) {
+	type item struct {
+		name  string
+		limit int64
+	}
+	var items []item
+
+	data := []byte(`{"items": [{"name": "a", "limit": 1}, {"name": "b", "limit": 2, "extra": 3}]}`)
+	unknown, err := decode(data, func(d *decoder, key string) (bool, error) {
+		if key != "items" {
+			return false, nil
+		}
+		return true, d.arrayValue(func() error {
+			var it item
+			err := d.objectValue(func(key string) (bool, error) {
+				switch key {
+				case "name":
+					return true, d.stringValue(&it.name)
+				case "limit":
+					return true, d.int64Value(&it.limit)
+				}
+				return false, nil
+			})
+			items = append(items, it)
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(items) != 2 || items[0] != (item{"a", 1}) || items[1] != (item{"b", 2}) {
+		t.Errorf("unexpected items %v", items)
+	}
+	if len(unknown) != 1 || unknown[0].Field != "items.extra" {
+		t.Errorf("expected items.extra to be unknown, got %v", unknown)
+	}
+}
+
+func TestDecodeFieldCoversConfig(t *testing.T) {
+	var conf Config
+
+	ct := reflect.TypeOf(conf)
+	for i := 0; i < ct.NumField(); i++ {
+		name := strings.Split(ct.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		d := &decoder{data: []byte("null")}
+		known, err := conf.decodeField(d, name)
+		if !known || err != nil {
+			t.Errorf("field %s is not decoded", name)
+		}
+	}
+}
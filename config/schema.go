@@ -0,0 +1,265 @@
+//go:build !tinygo
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Meta Schema
+// -----------------------------------------------------------------------------
+
+// Keywords accepted in `jsonschema:` struct tags. Values may contain commas
+// (as in patterns), so a comma only starts a new keyword when followed by
+// one of these.
+var schemaKeywords = []string{"enum", "pattern", "minimum", "maximum", "default"}
+
+type schemaProperty struct {
+	Type    string      `json:"type"`
+	Enum    []string    `json:"enum,omitempty"`
+	Pattern string      `json:"pattern,omitempty"`
+	Minimum *int64      `json:"minimum,omitempty"`
+	Maximum *int64      `json:"maximum,omitempty"`
+	Default interface{} `json:"default,omitempty"`
+
+	// Fields of nested objects
+	Properties schemaProperties `json:"properties,omitempty"`
+
+	// Elements of arrays
+	Items *schemaProperty `json:"items,omitempty"`
+
+	// Values of objects with arbitrary keys. Unknown fields of structs are
+	// left to the decoder, which only rejects them in strict mode.
+	AdditionalProperties *schemaProperty `json:"additionalProperties,omitempty"`
+}
+
+// Patterns are kept readable: '&' and the like are not escaped for HTML
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+type namedProperty struct {
+	name     string
+	property schemaProperty
+}
+
+// schemaProperties encodes as a JSON object keeping the order of the fields
+// in Config, so the generated schema reads like the struct.
+type schemaProperties []namedProperty
+
+func (props schemaProperties) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	for i, p := range props {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := marshalJSON(p.name)
+		if err != nil {
+			return nil, err
+		}
+		prop, err := marshalJSON(p.property)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(prop)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+type metaSchema struct {
+	ConfigSchema struct {
+		Type       string           `json:"type"`
+		Properties schemaProperties `json:"properties"`
+	} `json:"config_schema"`
+}
+
+func splitSchemaTag(tag string) [][2]string {
+	var ret [][2]string
+
+	for _, part := range strings.Split(tag, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		isKeyword := false
+		for _, k := range schemaKeywords {
+			if len(kv) == 2 && kv[0] == k {
+				isKeyword = true
+				break
+			}
+		}
+
+		if isKeyword || len(ret) == 0 {
+			ret = append(ret, [2]string{kv[0], strings.TrimPrefix(part, kv[0]+"=")})
+		} else {
+			ret[len(ret)-1][1] += "," + part
+		}
+	}
+
+	return ret
+}
+
+func parseSchemaValue(kind reflect.Kind, value string) (interface{}, error) {
+	switch kind {
+	case reflect.Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.String:
+		return value, nil
+	}
+	return nil, fmt.Errorf("unsupported kind %v", kind)
+}
+
+func getSchemaType(t reflect.Type) (schemaProperty, error) {
+	prop := schemaProperty{}
+
+	switch t.Kind() {
+	case reflect.Int64:
+		prop.Type = "integer"
+	case reflect.Bool:
+		prop.Type = "boolean"
+	case reflect.String:
+		prop.Type = "string"
+	case reflect.Struct:
+		prop.Type = "object"
+		props, err := getSchemaProperties(t)
+		if err != nil {
+			return prop, err
+		}
+		prop.Properties = props
+	case reflect.Slice:
+		prop.Type = "array"
+		items, err := getSchemaType(t.Elem())
+		if err != nil {
+			return prop, err
+		}
+		prop.Items = &items
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return prop, fmt.Errorf("unsupported type %v", t)
+		}
+		prop.Type = "object"
+		values, err := getSchemaType(t.Elem())
+		if err != nil {
+			return prop, err
+		}
+		prop.AdditionalProperties = &values
+	default:
+		return prop, fmt.Errorf("unsupported type %v", t)
+	}
+
+	return prop, nil
+}
+
+func getSchemaProperty(field reflect.StructField) (schemaProperty, error) {
+	prop, err := getSchemaType(field.Type)
+	if err != nil {
+		return prop, err
+	}
+
+	tag, ok := field.Tag.Lookup("jsonschema")
+	if !ok {
+		return prop, nil
+	}
+
+	// Keywords of arrays constrain their elements
+	target, kind := &prop, field.Type.Kind()
+	if prop.Items != nil {
+		target, kind = prop.Items, field.Type.Elem().Kind()
+	}
+
+	for _, kv := range splitSchemaTag(tag) {
+		switch kv[0] {
+		case "enum":
+			target.Enum = append(target.Enum, kv[1])
+		case "pattern":
+			target.Pattern = kv[1]
+		case "minimum", "maximum":
+			n, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return prop, fmt.Errorf("invalid %s: %v", kv[0], err)
+			}
+			if kv[0] == "minimum" {
+				target.Minimum = &n
+			} else {
+				target.Maximum = &n
+			}
+		case "default":
+			v, err := parseSchemaValue(kind, kv[1])
+			if err != nil {
+				return prop, fmt.Errorf("invalid default: %v", err)
+			}
+			target.Default = v
+		default:
+			return prop, fmt.Errorf("unknown keyword %q", kv[0])
+		}
+	}
+
+	return prop, nil
+}
+
+// getSchemaProperties describes the fields of a struct having a json tag
+func getSchemaProperties(t reflect.Type) (schemaProperties, error) {
+	var props schemaProperties
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		prop, err := getSchemaProperty(field)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", field.Name, err)
+		}
+
+		props = append(props, namedProperty{name, prop})
+	}
+
+	return props, nil
+}
+
+// MetaSchema produces the contents of rate-limiting.meta.json, which the
+// gateway uses to validate filter configurations, from the json and
+// jsonschema tags of Config. Unknown fields are accepted, as they are with
+// strict disabled: in strict mode, the filter rejects them when it starts.
+func MetaSchema() ([]byte, error) {
+	schema := metaSchema{}
+	schema.ConfigSchema.Type = "object"
+
+	props, err := getSchemaProperties(reflect.TypeOf(Config{}))
+	if err != nil {
+		return nil, err
+	}
+	schema.ConfigSchema.Properties = props
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "   ")
+	if err := enc.Encode(schema); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSplitSchemaTag(t *testing.T) {
+	kvs := splitSchemaTag("enum=a,enum=b,pattern=^[a,b=c]$,default=a")
+
+	expected := [][2]string{{"enum", "a"}, {"enum", "b"}, {"pattern", "^[a,b=c]$"}, {"default", "a"}}
+	if len(kvs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, kvs)
+	}
+	for i := range expected {
+		if kvs[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], kvs[i])
+		}
+	}
+}
+
+func TestMetaSchemaUpToDate(t *testing.T) {
+	expected, err := MetaSchema()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actual, err := os.ReadFile("../rate-limiting.meta.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("rate-limiting.meta.json is out of date with config.Config, run `go generate ./...`")
+	}
+}
+
+// Validate rejects integers below some minimum for every field, which the
+// gateway must know of so as not to accept configurations the filter rejects.
+// Unknown fields are left to the decoder, which rejects them in strict mode.
+func TestMetaSchemaMatchesValidate(t *testing.T) {
+	data, err := MetaSchema()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type property struct {
+		Type                 string              `json:"type"`
+		Minimum              *int64              `json:"minimum"`
+		Properties           map[string]property `json:"properties"`
+		Items                *property           `json:"items"`
+		AdditionalProperties json.RawMessage     `json:"additionalProperties"`
+	}
+	var schema struct {
+		ConfigSchema property `json:"config_schema"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	var check func(path string, p property)
+	check = func(path string, p property) {
+		if p.Type == "integer" && p.Minimum == nil {
+			t.Errorf("%s has no minimum", path)
+		}
+		for name, child := range p.Properties {
+			check(strings.TrimPrefix(path+"."+name, "."), child)
+		}
+		if p.Type == "object" && p.Properties != nil && p.AdditionalProperties != nil {
+			t.Errorf("%s restricts unknown fields", path)
+		}
+		if p.Items != nil {
+			check(path+".*", *p.Items)
+		}
+		var values property
+		if json.Unmarshal(p.AdditionalProperties, &values) == nil {
+			check(path+".*", values)
+		}
+	}
+	check("", schema.ConfigSchema)
+}
+
+// The gateway must accept unknown fields for strict to be disabled
+func TestMetaSchemaNotStrict(t *testing.T) {
+	data, err := MetaSchema()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var schema struct {
+		ConfigSchema struct {
+			Properties           map[string]json.RawMessage `json:"properties"`
+			AdditionalProperties *bool                      `json:"additionalProperties"`
+		} `json:"config_schema"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := []byte(`{"strict": false, "minute": 5, "minutes": 10}`)
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(conf, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for name := range fields {
+		_, known := schema.ConfigSchema.Properties[name]
+		if !known && schema.ConfigSchema.AdditionalProperties != nil && !*schema.ConfigSchema.AdditionalProperties {
+			t.Errorf("expected the schema to accept unknown field %q", name)
+		}
+	}
+
+	var c Config
+	if err := Load(conf, &c); err != nil {
+		t.Errorf("expected the filter to accept unknown fields, got %v", err)
+	}
+}
@@ -3,5 +3,3 @@ module github.com/kong/proxy-wasm-go-rate-limiting
 go 1.20
 
 require github.com/tetratelabs/proxy-wasm-go-sdk v0.19.0
-
-require github.com/pquerna/ffjson v0.0.0-20190930134022-aa0246cd15f7
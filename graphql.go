@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/kong/proxy-wasm-go-rate-limiting/config"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// -----------------------------------------------------------------------------
+// GraphQL Documents
+// -----------------------------------------------------------------------------
+
+// GraphQL documents are parsed only as far as needed to estimate the cost of
+// an operation: the tree of field selections of each operation and fragment.
+// Arguments, variables and directives are skipped, and nothing is checked
+// against a schema, which is left to the upstream.
+
+// Selections nested deeper are rejected rather than estimated, as the
+// parser recurses once per level
+const maxGraphQLNesting = 64
+
+type gqlSelection struct {
+	field    bool           // a field, else a fragment spread or inline fragment
+	fragment string         // name of a spread fragment
+	children []gqlSelection // selection set of a field or inline fragment
+}
+
+type gqlDocument struct {
+	operations map[string][]gqlSelection // by name, empty for an anonymous one
+	count      int                       // number of operations, named or not
+	fragments  map[string][]gqlSelection
+}
+
+type gqlToken struct {
+	kind  byte // 'n' for a name, 'v' for a number or string, else the punctuator
+	value string
+}
+
+// gqlParser tokenizes and parses a document with one token of lookahead
+type gqlParser struct {
+	src     string
+	pos     int
+	tok     gqlToken
+	nesting int
+}
+
+var errGraphQLSyntax = errors.New("invalid GraphQL document")
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isNameContinue(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+// advance reads the next token, skipping whitespace, commas and comments
+func (p *gqlParser) advance() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+		} else if strings.HasPrefix(p.src[p.pos:], "\ufeff") {
+			p.pos += len("\ufeff")
+		} else {
+			break
+		}
+	}
+
+	if p.pos == len(p.src) {
+		p.tok = gqlToken{}
+		return nil
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case isNameStart(c):
+		for p.pos < len(p.src) && isNameContinue(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{'n', p.src[start:p.pos]}
+	case c == '-' || (c >= '0' && c <= '9'):
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) != -1 {
+			p.pos++
+		}
+		p.tok = gqlToken{'v', p.src[start:p.pos]}
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		p.pos += 3
+		for {
+			end := strings.Index(p.src[p.pos:], `"""`)
+			if end == -1 {
+				return errGraphQLSyntax
+			}
+			p.pos += end + 3
+			// An escaped \""" does not end the block string
+			if p.src[p.pos-4] != '\\' {
+				break
+			}
+		}
+		p.tok = gqlToken{'v', p.src[start:p.pos]}
+	case c == '"':
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			} else if p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+				return errGraphQLSyntax
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			return errGraphQLSyntax
+		}
+		p.pos++
+		p.tok = gqlToken{'v', p.src[start:p.pos]}
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{'.', "..."}
+	case strings.IndexByte("!$&()=:@[]{|}", c) != -1:
+		p.pos++
+		p.tok = gqlToken{c, string(c)}
+	default:
+		return errGraphQLSyntax
+	}
+	return nil
+}
+
+// expect consumes a token of the given kind
+func (p *gqlParser) expect(kind byte) (string, error) {
+	if p.tok.kind != kind {
+		return "", errGraphQLSyntax
+	}
+	value := p.tok.value
+	return value, p.advance()
+}
+
+// skipBalanced consumes arguments, variable definitions or a value, from an
+// opening bracket to the matching closing one
+func (p *gqlParser) skipBalanced() error {
+	depth := 0
+	for {
+		switch p.tok.kind {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case 0:
+			return errGraphQLSyntax
+		}
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func (p *gqlParser) skipDirectives() error {
+	for p.tok.kind == '@' {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.expect('n'); err != nil {
+			return err
+		}
+		if p.tok.kind == '(' {
+			if err := p.skipBalanced(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// selectionSet parses the selections between braces
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if _, err := p.expect('{'); err != nil {
+		return nil, err
+	}
+
+	p.nesting++
+	if p.nesting > maxGraphQLNesting {
+		return nil, fmt.Errorf("selections nested deeper than %d levels", maxGraphQLNesting)
+	}
+	defer func() { p.nesting-- }()
+
+	sels := []gqlSelection{}
+	for p.tok.kind != '}' {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, errGraphQLSyntax
+	}
+	return sels, p.advance()
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var sel gqlSelection
+	var err error
+
+	if p.tok.kind == '.' {
+		if err = p.advance(); err != nil {
+			return sel, err
+		}
+
+		// Fragment spread, unless a type condition or selection set follows
+		if p.tok.kind == 'n' && p.tok.value != "on" {
+			sel.fragment = p.tok.value
+			if err = p.advance(); err != nil {
+				return sel, err
+			}
+			return sel, p.skipDirectives()
+		}
+
+		if p.tok.kind == 'n' {
+			if err = p.advance(); err != nil {
+				return sel, err
+			}
+			if _, err = p.expect('n'); err != nil {
+				return sel, err
+			}
+		}
+		if err = p.skipDirectives(); err != nil {
+			return sel, err
+		}
+		sel.children, err = p.selectionSet()
+		return sel, err
+	}
+
+	// Field, possibly aliased
+	sel.field = true
+	if _, err = p.expect('n'); err != nil {
+		return sel, err
+	}
+	if p.tok.kind == ':' {
+		if err = p.advance(); err != nil {
+			return sel, err
+		}
+		if _, err = p.expect('n'); err != nil {
+			return sel, err
+		}
+	}
+	if p.tok.kind == '(' {
+		if err = p.skipBalanced(); err != nil {
+			return sel, err
+		}
+	}
+	if err = p.skipDirectives(); err != nil {
+		return sel, err
+	}
+	if p.tok.kind == '{' {
+		sel.children, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+// definition parses an operation or a fragment into the document
+func (p *gqlParser) definition(doc *gqlDocument) error {
+	// Query shorthand
+	if p.tok.kind == '{' {
+		sels, err := p.selectionSet()
+		doc.operations[""] = sels
+		doc.count++
+		return err
+	}
+
+	keyword, err := p.expect('n')
+	if err != nil {
+		return err
+	}
+
+	switch keyword {
+	case "query", "mutation", "subscription":
+		name := ""
+		if p.tok.kind == 'n' {
+			name = p.tok.value
+			if err := p.advance(); err != nil {
+				return err
+			}
+		}
+		if p.tok.kind == '(' {
+			if err := p.skipBalanced(); err != nil {
+				return err
+			}
+		}
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+		sels, err := p.selectionSet()
+		doc.operations[name] = sels
+		doc.count++
+		return err
+
+	case "fragment":
+		name, err := p.expect('n')
+		if err != nil {
+			return err
+		}
+		if on, err := p.expect('n'); err != nil || on != "on" {
+			return errGraphQLSyntax
+		}
+		if _, err := p.expect('n'); err != nil {
+			return err
+		}
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+		sels, err := p.selectionSet()
+		doc.fragments[name] = sels
+		return err
+	}
+
+	return errGraphQLSyntax
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	doc := &gqlDocument{
+		operations: make(map[string][]gqlSelection),
+		fragments:  make(map[string][]gqlSelection),
+	}
+
+	p := &gqlParser{src: src}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	for p.tok.kind != 0 {
+		if err := p.definition(doc); err != nil {
+			return nil, err
+		}
+	}
+	if doc.count == 0 {
+		return nil, errors.New("no operation in GraphQL document")
+	}
+	return doc, nil
+}
+
+// -----------------------------------------------------------------------------
+// GraphQL Cost
+// -----------------------------------------------------------------------------
+
+// gqlCost estimates the cost of selections, expanding fragment spreads. The
+// cost of each fragment is computed once, so that fragments spread many
+// times cannot make the estimation itself expensive.
+type gqlCost struct {
+	doc      *gqlDocument
+	measure  func(c *gqlCost, sels []gqlSelection) int64
+	memo     map[string]int64
+	visiting map[string]bool
+}
+
+func (c *gqlCost) fragment(name string) int64 {
+	if cost, ok := c.memo[name]; ok {
+		return cost
+	}
+	// Fragments spreading themselves are invalid, and cost nothing more
+	if c.visiting[name] {
+		return 0
+	}
+
+	c.visiting[name] = true
+	cost := c.measure(c, c.doc.fragments[name])
+	delete(c.visiting, name)
+
+	c.memo[name] = cost
+	return cost
+}
+
+// countFields counts the fields selected at all levels
+func countFields(c *gqlCost, sels []gqlSelection) int64 {
+	n := int64(0)
+	for _, sel := range sels {
+		switch {
+		case sel.field:
+			n += 1 + countFields(c, sel.children)
+		case sel.fragment != "":
+			n += c.fragment(sel.fragment)
+		default:
+			n += countFields(c, sel.children)
+		}
+	}
+	return n
+}
+
+// getDepth returns the number of levels of nested fields
+func getDepth(c *gqlCost, sels []gqlSelection) int64 {
+	depth := int64(0)
+	for _, sel := range sels {
+		switch {
+		case sel.field:
+			depth = max(depth, 1+getDepth(c, sel.children))
+		case sel.fragment != "":
+			depth = max(depth, c.fragment(sel.fragment))
+		default:
+			depth = max(depth, getDepth(c, sel.children))
+		}
+	}
+	return depth
+}
+
+// getGraphQLOperation returns the name of the operation to execute, as
+// given by operationName or the only operation of the document, and its
+// cost in hits
+func getGraphQLOperation(query string, operationName string, costing string) (string, int64, error) {
+	doc, err := parseGraphQL(query)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if operationName == "" && doc.count > 1 {
+		return "", 0, errors.New("operationName is required for documents with many operations")
+	}
+	sels, ok := doc.operations[operationName]
+	if !ok && operationName == "" {
+		// The only operation of the document is named
+		for name, s := range doc.operations {
+			operationName, sels, ok = name, s, true
+		}
+	}
+	if !ok {
+		return "", 0, fmt.Errorf("unknown operation %q", operationName)
+	}
+
+	c := &gqlCost{
+		doc:      doc,
+		memo:     make(map[string]int64),
+		visiting: make(map[string]bool),
+	}
+	switch costing {
+	case "fields":
+		c.measure = countFields
+	case "depth":
+		c.measure = getDepth
+	default:
+		return operationName, 1, nil
+	}
+	return operationName, max(1, c.measure(c, sels)), nil
+}
+
+// -----------------------------------------------------------------------------
+// GraphQL Request Bodies
+// -----------------------------------------------------------------------------
+
+// Bodies are JSON objects holding the document along with variables and
+// extensions. Only the strings of the fields needed to estimate the cost are
+// decoded; other values are skipped by counting brackets rather than by
+// recursing, as clients may nest variables as deep as the body allows.
+
+var errJSONSyntax = errors.New("invalid JSON")
+
+type jsonScanner struct {
+	data []byte
+	pos  int
+}
+
+// peek returns the next significant byte, or 0 at the end of the body
+func (s *jsonScanner) peek() byte {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return s.data[s.pos]
+		}
+	}
+	return 0
+}
+
+func (s *jsonScanner) expect(c byte) error {
+	if s.peek() != c {
+		return errJSONSyntax
+	}
+	s.pos++
+	return nil
+}
+
+func (s *jsonScanner) hex4() (rune, error) {
+	if s.pos+4 > len(s.data) {
+		return 0, errJSONSyntax
+	}
+	n, err := strconv.ParseUint(string(s.data[s.pos:s.pos+4]), 16, 16)
+	if err != nil {
+		return 0, errJSONSyntax
+	}
+	s.pos += 4
+	return rune(n), nil
+}
+
+// str decodes a string, or null as an empty string
+func (s *jsonScanner) str() (string, error) {
+	if s.peek() == 'n' && bytes.HasPrefix(s.data[s.pos:], []byte("null")) {
+		s.pos += len("null")
+		return "", nil
+	}
+	if err := s.expect('"'); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		s.pos++
+		switch {
+		case c == '"':
+			return sb.String(), nil
+		case c < 0x20:
+			return "", errJSONSyntax
+		case c != '\\':
+			sb.WriteByte(c)
+			continue
+		}
+
+		if s.pos >= len(s.data) {
+			break
+		}
+		c = s.data[s.pos]
+		s.pos++
+		switch c {
+		case '"', '\\', '/':
+			sb.WriteByte(c)
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'u':
+			r, err := s.hex4()
+			if err != nil {
+				return "", err
+			}
+			if utf16.IsSurrogate(r) && bytes.HasPrefix(s.data[s.pos:], []byte("\\u")) {
+				s.pos += 2
+				r2, err := s.hex4()
+				if err != nil {
+					return "", err
+				}
+				r = utf16.DecodeRune(r, r2)
+			}
+			sb.WriteRune(r)
+		default:
+			return "", errJSONSyntax
+		}
+	}
+	return "", errJSONSyntax
+}
+
+// skip consumes a value of any type, only checking that brackets balance
+func (s *jsonScanner) skip() error {
+	depth := 0
+	for {
+		switch c := s.peek(); c {
+		case 0:
+			return errJSONSyntax
+		case '"':
+			if _, err := s.str(); err != nil {
+				return err
+			}
+		case '{', '[':
+			depth++
+			s.pos++
+		case '}', ']', ',', ':':
+			if depth == 0 {
+				return errJSONSyntax
+			}
+			if c == '}' || c == ']' {
+				depth--
+			}
+			s.pos++
+		default:
+			// Numbers and literals
+			for s.pos < len(s.data) && strings.IndexByte(" \t\n\r\",:[]{}", s.data[s.pos]) == -1 {
+				s.pos++
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// object decodes an object, calling field for each key with the scanner
+// positioned on its value
+func (s *jsonScanner) object(field func(key string) error) error {
+	if err := s.expect('{'); err != nil {
+		return err
+	}
+	if s.peek() == '}' {
+		s.pos++
+		return nil
+	}
+
+	for {
+		if s.peek() != '"' {
+			return errJSONSyntax
+		}
+		key, err := s.str()
+		if err != nil {
+			return err
+		}
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+		if err := field(key); err != nil {
+			return err
+		}
+
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return errJSONSyntax
+		}
+	}
+}
+
+// gqlRequest is a GraphQL request as sent in a body
+type gqlRequest struct {
+	query         string
+	operationName string
+	persisted     bool // sent with a persisted query hash, possibly instead of the document
+}
+
+func (s *jsonScanner) request(req *gqlRequest) error {
+	return s.object(func(key string) error {
+		switch key {
+		case "query":
+			query, err := s.str()
+			req.query = query
+			return err
+		case "operationName":
+			name, err := s.str()
+			if name != "" {
+				req.operationName = name
+			}
+			return err
+		case "extensions":
+			if s.peek() != '{' {
+				return s.skip()
+			}
+			return s.object(func(key string) error {
+				if key == "persistedQuery" && s.peek() != 'n' {
+					req.persisted = true
+				}
+				return s.skip()
+			})
+		}
+		return s.skip()
+	})
+}
+
+// parseGraphQLBody decodes a JSON body, holding a request or a batch of
+// them, taking the name of the operation of a single request from
+// operationName unless the body holds it
+func parseGraphQLBody(body []byte, operationName string) ([]gqlRequest, error) {
+	var reqs []gqlRequest
+
+	s := &jsonScanner{data: body}
+	if s.peek() != '[' {
+		req := gqlRequest{operationName: operationName}
+		if err := s.request(&req); err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	} else {
+		s.pos++
+		for s.peek() != ']' {
+			if len(reqs) > 0 {
+				if err := s.expect(','); err != nil {
+					return nil, err
+				}
+			}
+			req := gqlRequest{}
+			if err := s.request(&req); err != nil {
+				return nil, err
+			}
+			reqs = append(reqs, req)
+		}
+		s.pos++
+	}
+
+	if s.peek() != 0 {
+		return nil, errJSONSyntax
+	}
+	if len(reqs) == 0 {
+		return nil, errors.New("empty batch of GraphQL requests")
+	}
+	return reqs, nil
+}
+
+// -----------------------------------------------------------------------------
+// GraphQL Requests
+// -----------------------------------------------------------------------------
+
+// getQueryParams returns the parameters of the query string of the request
+func getQueryParams() url.Values {
+	path, err := proxywasm.GetHttpRequestHeader(":path")
+	if err != nil {
+		return url.Values{}
+	}
+
+	i := strings.IndexByte(path, '?')
+	if i == -1 {
+		return url.Values{}
+	}
+	params, err := url.ParseQuery(path[i+1:])
+	if err != nil {
+		return url.Values{}
+	}
+	return params
+}
+
+// isCountedApart tells whether the operation is listed in graphql_operations.
+// Names are chosen by clients, so counting others apart would let them
+// evade their limits and fill the store with counters.
+func isCountedApart(conf *config.Config, operation string) bool {
+	for _, name := range conf.GraphQLOperations {
+		if name == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// limitGraphQL checks the operations of GraphQL requests against the limits,
+// counting them as their estimated cost. Batches count as the sum of their
+// operations, together with the operations which are not counted apart.
+// Persisted queries sent without their document cannot be estimated, and
+// count as one hit.
+func limitGraphQL(ctx *RateLimitingContext, reqs []gqlRequest) types.Action {
+	operation, cost := "", int64(0)
+	for _, req := range reqs {
+		if req.persisted && req.query == "" {
+			operation = ""
+			cost++
+			continue
+		}
+
+		name, c, err := getGraphQLOperation(req.query, req.operationName, ctx.conf.GraphQLCost)
+		if err != nil {
+			proxywasm.LogDebugf("rejecting GraphQL request: %v", err)
+			return sendHttpResponse(400, nil, "Go informs: invalid GraphQL request")
+		}
+		operation = name
+		cost += c
+	}
+	if len(reqs) > 1 || !isCountedApart(ctx.conf, operation) {
+		operation = ""
+	}
+	ctx.operation = operation
+	ctx.cost = cost
+
+	ts := getTimestamps(ctx.clock.Now().In(ctx.location))
+	return rateLimit(ctx, ts)
+}
+
+// onGraphQLRequestHeaders limits GraphQL requests sent with GET from their
+// query string. The headers of requests sent with POST are held until their
+// body has been read. Other requests, such as CORS preflights, are limited
+// as any request.
+func onGraphQLRequestHeaders(ctx *RateLimitingContext, ts *Timestamps, eof bool) types.Action {
+	method, _ := proxywasm.GetHttpRequestHeader(":method")
+	if method == "POST" && !eof {
+		ctx.graphqlBody = true
+		return types.ActionPause
+	}
+
+	params := getQueryParams()
+	if method == "POST" || params.Has("query") {
+		return limitGraphQL(ctx, []gqlRequest{{query: params.Get("query"), operationName: params.Get("operationName")}})
+	}
+	return rateLimit(ctx, ts)
+}
+
+func (ctx *RateLimitingContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.Action {
+	if !ctx.graphqlBody {
+		return types.ActionContinue
+	}
+
+	if int64(bodySize) > ctx.conf.GraphQLMaxBody {
+		ctx.graphqlBody = false
+		return sendHttpResponse(413, nil, "Go informs: GraphQL request too large")
+	}
+	// The host buffers the body until the whole of it is there
+	if !endOfStream {
+		return types.ActionPause
+	}
+	ctx.graphqlBody = false
+
+	body, err := proxywasm.GetHttpRequestBody(0, bodySize)
+	if err != nil && err != types.ErrorStatusNotFound {
+		proxywasm.LogErrorf("could not read GraphQL request: %v", err)
+		if !ctx.conf.FaultTolerant {
+			return sendFailure(ctx)
+		}
+		return types.ActionContinue
+	}
+
+	// The body is either the document itself, or JSON holding one request
+	// or a batch of them
+	operationName := getQueryParams().Get("operationName")
+	contentType, _ := proxywasm.GetHttpRequestHeader("content-type")
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "application/graphql" {
+		return limitGraphQL(ctx, []gqlRequest{{query: string(body), operationName: operationName}})
+	}
+
+	reqs, err := parseGraphQLBody(body, operationName)
+	if err != nil {
+		proxywasm.LogDebugf("rejecting GraphQL request: %v", err)
+		return sendHttpResponse(400, nil, "Go informs: invalid GraphQL request")
+	}
+	return limitGraphQL(ctx, reqs)
+}
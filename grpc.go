@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// -----------------------------------------------------------------------------
+// gRPC Responses
+// -----------------------------------------------------------------------------
+
+// gRPC clients do not read the status or body of HTTP error responses, and
+// report them as an opaque UNAVAILABLE or UNKNOWN. gRPC requests are rejected
+// instead with a trailers-only response: HTTP status 200, and the gRPC status
+// in headers of a response without body.
+
+// Status codes from https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+)
+
+// isGrpcRequest tells whether the content type of the request is gRPC,
+// as application/grpc or application/grpc+<message format>
+func isGrpcRequest() bool {
+	contentType, err := proxywasm.GetHttpRequestHeader("content-type")
+	if err != nil {
+		return false
+	}
+
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+")
+}
+
+// encodeGrpcMessage percent-encodes the message for the grpc-message header,
+// as required for bytes outside of printable ASCII and for '%'
+func encodeGrpcMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Protocol buffers encoding, limited to what a google.rpc.Status needs
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendVarint(buf, uint64(field<<3))
+	return appendVarint(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, data []byte) []byte {
+	buf = appendVarint(buf, uint64(field<<3|2))
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+const retryInfoType = "type.googleapis.com/google.rpc.RetryInfo"
+
+// getGrpcStatusDetails returns the google.rpc.Status of the response, with
+// a google.rpc.RetryInfo telling clients when to retry, encoded for the
+// grpc-status-details-bin header
+func getGrpcStatusDetails(code int, msg string, retryDelay int64) string {
+	// google.protobuf.Duration { seconds = 1 }
+	duration := appendVarintField(nil, 1, uint64(retryDelay))
+
+	// google.rpc.RetryInfo { retry_delay = 1 }
+	retryInfo := appendBytesField(nil, 1, duration)
+
+	// google.protobuf.Any { type_url = 1, value = 2 }
+	detail := appendBytesField(nil, 1, []byte(retryInfoType))
+	detail = appendBytesField(detail, 2, retryInfo)
+
+	// google.rpc.Status { code = 1, message = 2, details = 3 }
+	status := appendVarintField(nil, 1, uint64(code))
+	status = appendBytesField(status, 2, []byte(msg))
+	status = appendBytesField(status, 3, detail)
+
+	return base64.RawStdEncoding.EncodeToString(status)
+}
+
+// sendGrpcResponse replies to the client with a gRPC status and stops the
+// request, telling when to retry if retryDelay is positive. If the response
+// cannot be sent, the request is let through.
+func sendGrpcResponse(code int, msg string, headers [][2]string, retryDelay int64) types.Action {
+	pairs := append([][2]string{
+		{"content-type", "application/grpc"},
+		{"grpc-status", fmt.Sprintf("%d", code)},
+		{"grpc-message", encodeGrpcMessage(msg)},
+	}, headers...)
+	if retryDelay > 0 {
+		pairs = append(pairs, [2]string{"grpc-status-details-bin", getGrpcStatusDetails(code, msg, retryDelay)})
+	}
+
+	if err := proxywasm.SendHttpResponse(200, pairs, nil, -1); err != nil {
+		proxywasm.LogErrorf("could not send gRPC status %d: %v", code, err)
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+// -----------------------------------------------------------------------------
+// gRPC Methods
+// -----------------------------------------------------------------------------
+
+// parseGrpcPath returns the service and method of a gRPC request from its
+// path, /package.Service/Method
+func parseGrpcPath(path string) (string, string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return "", "", false
+	}
+
+	parts := strings.Split(path[1:], "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// getGrpcMethodLimits returns the limits of the gRPC method of the request,
+// or else of its service, along with the name they are configured under
+func getGrpcMethodLimits(grpcMethodLimits map[string]map[string]int64) (string, map[string]int64, bool) {
+	path, err := proxywasm.GetHttpRequestHeader(":path")
+	if err != nil {
+		return "", nil, false
+	}
+
+	service, method, ok := parseGrpcPath(path)
+	if !ok {
+		return "", nil, false
+	}
+
+	for _, name := range []string{service + "/" + method, service} {
+		if limits, ok := grpcMethodLimits[name]; ok {
+			return name, limits, true
+		}
+	}
+	return "", nil, false
+}
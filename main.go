@@ -1,8 +1,14 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,33 +29,84 @@ func max(a int64, b int64) int64 {
 	return b
 }
 
-func getProperty(namespace string, property string) string {
-	bytes, err := proxywasm.GetProperty([]string{namespace, property})
-	if err != nil {
-		return string(bytes)
+func getLimits(l config.Limits) map[string]int64 {
+	return map[string]int64{
+		"second": l.Second,
+		"minute": l.Minute,
+		"hour":   l.Hour,
+		"day":    l.Day,
+		"month":  l.Month,
+		"year":   l.Year,
 	}
-	return ""
+}
+
+// unlimited tells whether no period of the limits is set
+func unlimited(limits map[string]int64) bool {
+	for _, limit := range limits {
+		if limit != -1 {
+			return false
+		}
+	}
+	return true
 }
 
 // -----------------------------------------------------------------------------
 // Timestamps
 // -----------------------------------------------------------------------------
 
-type Timestamps map[string]int64
+// Clock provides the current time to the request path, so that tests
+// can control window boundaries.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var periods = []string{"second", "minute", "hour", "day", "month", "year"}
+
+type Timestamps struct {
+	now   int64
+	start map[string]int64 // start of the current window, per period
+	end   map[string]int64 // start of the next window, per period
+}
 
 func getTimestamps(t time.Time) *Timestamps {
-	ts := Timestamps{}
+	ts := Timestamps{
+		now:   t.Unix(),
+		start: make(map[string]int64),
+		end:   make(map[string]int64),
+	}
 
 	ye, mo, da := t.Year(), t.Month(), t.Day()
 	ho, mi, se, lo := t.Hour(), t.Minute(), t.Second(), t.Location()
 
-	ts["now"] = t.Unix()
-	ts["second"] = time.Date(ye, mo, da, ho, mi, se, 0, lo).Unix()
-	ts["minute"] = time.Date(ye, mo, da, ho, mi, 0, 0, lo).Unix()
-	ts["hour"] = time.Date(ye, mo, da, ho, 0, 0, 0, lo).Unix()
-	ts["day"] = time.Date(ye, mo, da, 0, 0, 0, 0, lo).Unix()
-	ts["month"] = time.Date(ye, mo, 1, 0, 0, 0, 0, lo).Unix()
-	ts["year"] = time.Date(ye, 1, 1, 0, 0, 0, 0, lo).Unix()
+	// Windows are calendar-aligned: days, months and years are not of
+	// fixed length across DST changes, 31-day months and leap years
+	starts := map[string]time.Time{
+		"second": time.Date(ye, mo, da, ho, mi, se, 0, lo),
+		"minute": time.Date(ye, mo, da, ho, mi, 0, 0, lo),
+		"hour":   time.Date(ye, mo, da, ho, 0, 0, 0, lo),
+		"day":    time.Date(ye, mo, da, 0, 0, 0, 0, lo),
+		"month":  time.Date(ye, mo, 1, 0, 0, 0, 0, lo),
+		"year":   time.Date(ye, 1, 1, 0, 0, 0, 0, lo),
+	}
+	ends := map[string]time.Time{
+		"second": starts["second"].Add(time.Second),
+		"minute": starts["minute"].Add(time.Minute),
+		"hour":   starts["hour"].Add(time.Hour),
+		"day":    starts["day"].AddDate(0, 0, 1),
+		"month":  starts["month"].AddDate(0, 1, 0),
+		"year":   starts["year"].AddDate(1, 0, 0),
+	}
+
+	for _, period := range periods {
+		ts.start[period] = starts[period].Unix()
+		ts.end[period] = ends[period].Unix()
+	}
 
 	return &ts
 }
@@ -60,35 +117,38 @@ func getTimestamps(t time.Time) *Timestamps {
 
 type VMContext struct {
 	types.DefaultVMContext
+	clock Clock
+	getProperty PropertyGetter
 }
 
-var expiration map[string]int64
 var xRateLimitLimit map[string]string
 var xRateLimitRemaining map[string]string
+var storeFullCounter proxywasm.MetricCounter
+var evictionCounter proxywasm.MetricCounter
 
-func (*VMContext) NewPluginContext(vmID uint32) types.PluginContext {
-	expiration = map[string]int64{
-		"second": 1,
-		"minute": 60,
-		"hour":   3600,
-		"day":    86400,
-		"month":  2592000,
-		"year":   31536000,
-	}
-	
-	time.LoadLocation("")
-
+func (vm *VMContext) NewPluginContext(vmID uint32) types.PluginContext {
 	xRateLimitLimit = make(map[string]string)
 	xRateLimitRemaining = make(map[string]string)
 
-	for k, _ := range expiration {
+	for _, k := range periods {
 		t := strings.Title(k)
 
 		xRateLimitLimit[k] = "X-RateLimit-Limit-" + t
 		xRateLimitRemaining[k] = "X-RateLimit-Remaining-" + t
 	}
 
-	return &PluginContext{}
+	storeFullCounter = proxywasm.DefineCounterMetric("rate_limiting_store_full")
+	evictionCounter = proxywasm.DefineCounterMetric("rate_limiting_evictions")
+
+	clock := vm.clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	return &PluginContext{
+		clock: clock,
+		properties: newProperties(vm.getProperty),
+	}
 }
 
 // -----------------------------------------------------------------------------
@@ -97,8 +157,21 @@ func (*VMContext) NewPluginContext(vmID uint32) types.PluginContext {
 
 type PluginContext struct {
 	types.DefaultPluginContext
+	clock Clock
+	properties *Properties
+	instance string
+	location *time.Location
 	conf config.Config
 	limits map[string]int64
+	aggregateLimits map[string]int64
+	methodLimits map[string]map[string]int64
+	grpcMethodLimits map[string]map[string]int64
+	throttle *Throttle
+	cluster *Cluster
+	batch *Batch
+	connections *Connections
+	legacy *legacyRecords
+	namespace string
 }
 
 func (ctx *PluginContext) OnPluginStart(confSize int) types.OnPluginStartStatus {
@@ -113,25 +186,151 @@ func (ctx *PluginContext) OnPluginStart(confSize int) types.OnPluginStartStatus
 		proxywasm.LogCriticalf("error parsing plugin configuration: %v", err)
 		return types.OnPluginStartStatusFailed
 	}
+	for _, w := range ctx.conf.Warnings() {
+		proxywasm.LogWarnf("ignoring plugin configuration: %v", w)
+	}
+
+	err = ctx.conf.Validate()
+	if err != nil {
+		proxywasm.LogCriticalf("error validating plugin configuration: %v", err)
+		return types.OnPluginStartStatusFailed
+	}
 
-	ctx.limits = map[string]int64{
-		"second": ctx.conf.Second,
-		"minute": ctx.conf.Minute,
-		"hour":   ctx.conf.Hour,
-		"day":    ctx.conf.Day,
-		"month":  ctx.conf.Month,
-		"year":   ctx.conf.Year,
+	// Properties are looked up on the configured host only
+	if ctx.conf.Host != "auto" {
+		ctx.properties.host = getHost(ctx.conf.Host)
+	}
+
+	// Filters with the same configuration share the filter_instance scope,
+	// across workers and nodes
+	sum := sha256.Sum256(data)
+	ctx.instance = fmt.Sprintf("%x", sum[:8])
+
+	// Calendar windows are aligned on the configured timezone; the
+	// timetzdata build tag embeds the IANA database in the filter
+	ctx.location, err = time.LoadLocation(ctx.conf.Timezone)
+	if err != nil {
+		proxywasm.LogCriticalf("error loading timezone %q: %v", ctx.conf.Timezone, err)
+		return types.OnPluginStartStatusFailed
+	}
+
+	ctx.limits = getLimits(config.Limits{
+		Second: ctx.conf.Second,
+		Minute: ctx.conf.Minute,
+		Hour:   ctx.conf.Hour,
+		Day:    ctx.conf.Day,
+		Month:  ctx.conf.Month,
+		Year:   ctx.conf.Year,
+	})
+
+	ctx.aggregateLimits = getLimits(ctx.conf.Aggregate)
+
+	ctx.namespace = getNamespace(&ctx.conf)
+	ctx.legacy = newLegacyRecords()
+
+	ctx.methodLimits = make(map[string]map[string]int64)
+	for method, l := range ctx.conf.Methods {
+		ctx.methodLimits[method] = getLimits(l)
+	}
+
+	ctx.grpcMethodLimits = make(map[string]map[string]int64)
+	for name, l := range ctx.conf.GrpcMethods {
+		ctx.grpcMethodLimits[name] = getLimits(l)
+	}
+
+	// Ticks are as frequent as the most frequent task needs: each task
+	// runs on the first tick past its own period
+	tickPeriod := int64(0)
+	setTickPeriod := func(ms int64) {
+		if tickPeriod == 0 || ms < tickPeriod {
+			tickPeriod = ms
+		}
+	}
+
+	if ctx.conf.Throttle {
+		ctx.throttle = newThrottle(&ctx.conf)
+		setTickPeriod(throttleTickPeriod)
+	}
+
+	if ctx.conf.FlushPeriod > 0 {
+		ctx.batch = newBatch(&ctx.conf)
+		setTickPeriod(ctx.conf.FlushPeriod)
+	}
+
+	if ctx.conf.Policy == "cluster" {
+		ctx.cluster = newCluster(&ctx.conf)
+		setTickPeriod(ctx.conf.SyncPeriod)
+	}
+
+	if ctx.conf.MaxConnections != -1 {
+		ctx.connections = newConnections()
+		setTickPeriod(connectionsRenewal * 1000)
+	}
+
+	if tickPeriod > 0 {
+		err = proxywasm.SetTickPeriodMilliSeconds(uint32(tickPeriod))
+		if err != nil {
+			proxywasm.LogCriticalf("error setting tick period: %v", err)
+			return types.OnPluginStartStatusFailed
+		}
 	}
 
 	return types.OnPluginStartStatusOK
 }
 
-func (ctx *PluginContext) NewHttpContext(pluginID uint32) types.HttpContext {
+func (ctx *PluginContext) OnTick() {
+	if ctx.throttle != nil {
+		ctx.throttle.onTick(ctx.clock.Now().In(ctx.location))
+	}
+	// Flushed hits are pushed to the cluster in the same tick
+	if ctx.batch != nil {
+		ctx.batch.onTick(ctx.clock.Now().In(ctx.location), ctx.cluster)
+	}
+	if ctx.cluster != nil {
+		ctx.cluster.onTick(ctx.clock.Now().In(ctx.location))
+	}
+	if ctx.connections != nil {
+		ctx.connections.onTick(ctx.clock.Now())
+	}
+}
+
+// The SDK creates an HTTP context for streams of a plugin whenever it can:
+// TCP contexts are only created when HTTP ones are not.
+func (ctx *PluginContext) NewHttpContext(contextID uint32) types.HttpContext {
+	if ctx.conf.Protocol != "http" {
+		return nil
+	}
+	return ctx.newRateLimitingContext(contextID)
+}
+
+func (ctx *PluginContext) NewTcpContext(contextID uint32) types.TcpContext {
+	if ctx.conf.Protocol != "tcp" {
+		return nil
+	}
+	return &ConnectionLimitingContext{
+		rl: ctx.newRateLimitingContext(contextID),
+		connections: ctx.connections,
+	}
+}
+
+func (ctx *PluginContext) newRateLimitingContext(contextID uint32) *RateLimitingContext {
 	return &RateLimitingContext{
+		contextID: contextID,
+		clock: ctx.clock,
+		location: ctx.location,
 		conf: &ctx.conf,
 		limits: &ctx.limits,
-		routeId: getProperty("kong", "route_id"),
-		serviceId: getProperty("kong", "service_id"),
+		aggregateLimits: &ctx.aggregateLimits,
+		methodLimits: &ctx.methodLimits,
+		grpcMethodLimits: &ctx.grpcMethodLimits,
+		throttle: ctx.throttle,
+		cluster: ctx.cluster,
+		batch: ctx.batch,
+		legacy: ctx.legacy,
+		namespace: ctx.namespace,
+		properties: ctx.properties,
+		instance: ctx.instance,
+		cost: 1,
 	}
 }
 
@@ -141,29 +340,201 @@ func (ctx *PluginContext) NewHttpContext(pluginID uint32) types.HttpContext {
 
 type RateLimitingContext struct {
 	types.DefaultHttpContext
+	contextID uint32
+	clock Clock
+	location *time.Location
 	conf *config.Config
 	limits *map[string]int64
-	routeId string
-	serviceId string
+	aggregateLimits *map[string]int64
+	methodLimits *map[string]map[string]int64
+	grpcMethodLimits *map[string]map[string]int64
+	throttle *Throttle
+	cluster *Cluster
+	batch *Batch
+	legacy *legacyRecords // records migrated from counters of earlier versions
+	namespace string
+	properties *Properties
+	instance string
+	scope string
+	id Identifier
+	method string // set when limits of the request method apply
+	grpc bool // rejected with gRPC statuses
+	rpc string // set when limits of the gRPC service or method apply
+	operation string // name of the GraphQL operation, when counted apart
+	cost int64 // hits counted for the request
+	graphqlBody bool // waiting for the body of a GraphQL request
 	headers map[string]string
 }
 
-func getForwardedIp() string {
-	return getProperty("ngx", "remote_addr")
+func getForwardedIp(props *Properties) string {
+	addr, _ := props.getString(remoteAddrProperty)
+	return stripPort(addr)
+}
+
+// getScope returns the scope of the counters of the request. When the host
+// does not tell the route or service of the request, counters are scoped to
+// the filter configuration rather than shared by all routes.
+func getScope(ctx *RateLimitingContext) string {
+	props := ctx.properties
+
+	switch ctx.conf.Scope {
+	case "global":
+		return "global"
+	case "service":
+		if service, ok := props.getString(serviceProperty); ok {
+			return "service:" + service
+		}
+	case "route":
+		if route, ok := props.getString(routeProperty); ok {
+			service, _ := props.getString(serviceProperty)
+			return "route:" + route + ":" + service
+		}
+	}
+
+	return "filter_instance:" + ctx.instance
+}
+
+// Version of the layout of counter keys, changed along with it so that
+// counters of another layout are left alone
+const keyVersion = "v2"
+
+// getCounterKey hashes the scope and identifier of counters into a key of
+// fixed length: identifiers may be long header values or personal data,
+// which must not end up in the store.
+func getCounterKey(namespace string, parts ...string) string {
+	return fmt.Sprintf("kong_wasm_rate_limiting_counters/%s:%s:%x",
+		keyVersion, namespace, hashParts(parts)[:16])
+}
+
+func hashParts(parts []string) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+// Counters are stored in one record per identifier, holding all periods,
+// which is reused from one window to the next: the proxy-wasm ABI offers no
+// way to delete or list keys, so keying on the window start would grow the
+// store forever. Requests of a method or gRPC method with limits of its own,
+// and listed GraphQL operations, are counted apart, as are connections.
+func getLocalKey(ctx *RateLimitingContext, id Identifier) string {
+	parts := []string{"local", ctx.scope, string(id), ctx.method}
+	if ctx.rpc != "" {
+		parts = append(parts, ctx.rpc)
+	}
+	if ctx.operation != "" {
+		parts = append(parts, "graphql:"+ctx.operation)
+	}
+	if ctx.conf.Protocol == "tcp" {
+		parts = append(parts, "tcp")
+	}
+	if ctx.conf.CounterSlots > 0 {
+		return getSlottedKey(ctx.namespace, ctx.conf.CounterSlots, parts...)
+	}
+	return getCounterKey(ctx.namespace, parts...)
+}
+
+// getSlottedKey hashes the counters into one of a number of slots, and into
+// their owner within it
+func getSlottedKey(namespace string, slots int64, parts ...string) string {
+	sum := hashParts(parts)
+	slot := binary.BigEndian.Uint64(sum) % uint64(slots)
+	owner := binary.BigEndian.Uint64(sum[8:]) | 1
+	return getSlotKey(getCounterKey(namespace, "slot", strconv.FormatUint(slot, 10)), owner)
+}
+
+// Aggregate counters are shared by all identifiers of a scope. Connections
+// are counted apart from requests.
+func getAggregateKey(ctx *RateLimitingContext) string {
+	if ctx.conf.Protocol == "tcp" {
+		return getCounterKey(ctx.namespace, "aggregate", ctx.scope, "tcp")
+	}
+	return getCounterKey(ctx.namespace, "aggregate", ctx.scope)
 }
 
-func getLocalKey(ctx *RateLimitingContext, id Identifier, period string, date int64) string {
-	return fmt.Sprintf("kong_wasm_rate_limiting_counters/ratelimit:%v:%v:%v:%v:%v",
-		ctx.routeId, ctx.serviceId, id, date, period)
+// Versions before records kept one counter per period and window, keyed as
+// ratelimit:<route>:<service>:<id>:<window start>:<period>, with route and
+// service ids which always read as empty: their counters were shared by all
+// routes. They are carried over into the default route scope, unless
+// namespaced or counted apart in ways these versions did not know of, such
+// as connections.
+const legacyKeyPrefix = "kong_wasm_rate_limiting_counters/ratelimit"
+
+func getLegacyKey(id Identifier, period string, ts *Timestamps) string {
+	return fmt.Sprintf("%s:::%s:%d:%s", legacyKeyPrefix, id, ts.start[period], period)
+}
+
+// getLegacyRecord returns a function building the record of the identifier
+// from its counters in earlier versions, or nil if they are not carried over
+func getLegacyRecord(ctx *RateLimitingContext, id Identifier, ts *Timestamps) func() counterRecord {
+	conf := ctx.conf
+	if conf.Protocol == "tcp" || conf.Scope != "route" || conf.CountersNamespace != "" || conf.ResetCountersOnChange ||
+		ctx.method != "" || ctx.rpc != "" || ctx.operation != "" || ctx.legacy == nil {
+		return nil
+	}
+
+	return func() counterRecord {
+		return ctx.legacy.get(getLocalKey(ctx, id), func() counterRecord {
+			var rec counterRecord
+			for period, limit := range *ctx.limits {
+				if limit != -1 {
+					rec.set(period, ts.start[period], readLegacyCounter(getLegacyKey(id, period, ts)))
+				}
+			}
+			return rec
+		})
+	}
+}
+
+// getNamespace returns the namespace of the counters. When counters are
+// reset on changes, it holds a fingerprint of the limits and the criteria
+// to limit by, so that a new configuration uses new counters.
+func getNamespace(conf *config.Config) string {
+	if !conf.ResetCountersOnChange {
+		return conf.CountersNamespace
+	}
+
+	methods := make([]string, 0, len(conf.Methods))
+	for method := range conf.Methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d %d %d %d %d;%v;", conf.Second, conf.Minute, conf.Hour,
+		conf.Day, conf.Month, conf.Year, conf.Aggregate)
+	for _, method := range methods {
+		fmt.Fprintf(h, "%s=%v;", method, conf.Methods[method])
+	}
+
+	rpcs := make([]string, 0, len(conf.GrpcMethods))
+	for name := range conf.GrpcMethods {
+		rpcs = append(rpcs, name)
+	}
+	sort.Strings(rpcs)
+	for _, name := range rpcs {
+		fmt.Fprintf(h, "grpc %s=%v;", name, conf.GrpcMethods[name])
+	}
+	fmt.Fprintf(h, "%q %q %q", conf.LimitBy, conf.HeaderName, conf.Path)
+	if conf.GraphQL {
+		operations := append([]string(nil), conf.GraphQLOperations...)
+		sort.Strings(operations)
+		fmt.Fprintf(h, ";graphql %q %q", conf.GraphQLCost, operations)
+	}
+
+	return fmt.Sprintf("%s.%x", conf.CountersNamespace, h.Sum(nil)[:4])
 }
 
 type Identifier string
 
-func getIdentifier(conf *config.Config) Identifier {
+func getIdentifier(conf *config.Config, props *Properties) Identifier {
 	id := ""
 	if conf.LimitBy == "header" {
 		header, err := proxywasm.GetHttpRequestHeader(conf.HeaderName)
-		if err != nil {
+		if err == nil {
 			id = header
 		}
 	} else if conf.LimitBy == "path" {
@@ -179,101 +550,280 @@ func getIdentifier(conf *config.Config) Identifier {
 
 	// conf.LimitBy == "ip":
 
-	return Identifier(getForwardedIp())
+	return Identifier(getForwardedIp(props))
 }
 
-type Usage struct {
-	limit     int64
-	remaining int64
-	usage     int64
-	cas       uint32
+// signLimitsOverride returns the signature of limits overridden for the
+// identifier until the expiry, in Unix seconds: the hex HMAC-SHA256, keyed
+// with the shared secret, of the identifier, the limits and the expiry
+// separated by newlines
+func signLimitsOverride(secret string, id Identifier, limits string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(limits))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-func localPolicyUsage(ctx *RateLimitingContext, id Identifier, period string, ts *Timestamps) (int64, uint32, error) {
-	cacheKey := getLocalKey(ctx, id, period, (*ts)[period])
+// verifyLimitsOverride returns the limits of a header value signed as
+// "<limits>;exp=<expiry>;sig=<signature>", if the signature is valid for the
+// identifier and has not expired by now. Signed values can be replayed by
+// the client they were made for, until they expire.
+func verifyLimitsOverride(secret string, id Identifier, value string, now int64) (string, error) {
+	i := strings.LastIndex(value, ";sig=")
+	if i == -1 {
+		return "", fmt.Errorf("no signature")
+	}
+	j := strings.LastIndex(value[:i], ";exp=")
+	if j == -1 {
+		return "", fmt.Errorf("no expiry")
+	}
 
-	value, cas, err := proxywasm.GetSharedData(cacheKey)
+	limits, sig := value[:j], strings.ToLower(strings.TrimSpace(value[i+len(";sig="):]))
+	expires, err := strconv.ParseInt(strings.TrimSpace(value[j+len(";exp="):i]), 10, 64)
 	if err != nil {
-		if err == types.ErrorStatusNotFound {
-			return 0, 0, nil
+		return "", fmt.Errorf("invalid expiry %q", value[j+len(";exp="):i])
+	}
+
+	expected := signLimitsOverride(secret, id, limits, expires)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return "", fmt.Errorf("invalid signature")
+	}
+	if expires <= now {
+		return "", fmt.Errorf("expired at %d", expires)
+	}
+	return limits, nil
+}
+
+// Limits for a request can be overridden by a trusted component running
+// before this filter, e.g. an auth service knowing the plan of the caller,
+// through a request header or a property. Clients can send the header too,
+// so its value is only trusted when signed with the shared secret for the
+// identifier of the request and until an expiry, which cannot be replayed by
+// other clients nor for longer.
+func getLimitsOverride(conf *config.Config, props *Properties, id Identifier, ts *Timestamps) string {
+	if conf.LimitsOverrideHeader != "" {
+		value, err := proxywasm.GetHttpRequestHeader(conf.LimitsOverrideHeader)
+
+		// The header is meant for this filter only: never pass it upstream
+		if err == nil {
+			if err := proxywasm.RemoveHttpRequestHeader(conf.LimitsOverrideHeader); err != nil {
+				proxywasm.LogErrorf("could not remove limits override header: %v", err)
+			}
+		}
+
+		if err == nil && value != "" {
+			limits, err := verifyLimitsOverride(conf.LimitsOverrideSecret, id, value, ts.now)
+			if err == nil {
+				return limits
+			}
+			proxywasm.LogWarnf("ignoring limits override header: %v", err)
 		}
-		return 0, 0, err
 	}
 
-	ret := int64(binary.LittleEndian.Uint64(value))
-	return ret, cas, nil
+	if conf.LimitsOverrideProperty != "" {
+		if value, ok := props.lookup(strings.Split(conf.LimitsOverrideProperty, ".")); ok {
+			return value
+		}
+	}
+
+	return ""
 }
 
-func localPolicyIncrement(ctx *RateLimitingContext, id Identifier, counters map[string]Usage, ts *Timestamps) {
-	for period, usage := range counters {
-		cacheKey := getLocalKey(ctx, id, period, (*ts)[period])
+// overrideLimits applies limits given as comma-separated period=hits pairs,
+// e.g. "minute=100,hour=1000", on top of the configured ones. A limit of -1
+// disables the period.
+func overrideLimits(limits map[string]int64, override string) (map[string]int64, error) {
+	ret := make(map[string]int64, len(limits))
+	for period, limit := range limits {
+		ret[period] = limit
+	}
 
-		buf := make([]byte, 8)
-		value := usage.usage
-		cas := usage.cas
+	for _, pair := range strings.Split(override, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected period=hits, got %q", pair)
+		}
 
-		saved := false
-		var err error
-		for i := 0; i < 10; i++ {
-			binary.LittleEndian.PutUint64(buf, uint64(value+1))
-			err = proxywasm.SetSharedData(cacheKey, buf, cas)
-			if err == nil {
-				saved = true
-				break
-			} else if err == types.ErrorStatusCasMismatch {
-				// Get updated value, updated cas and retry
-				buf, cas, err = proxywasm.GetSharedData(cacheKey)
-				value = int64(binary.LittleEndian.Uint64(buf))
-			} else {
-				break
+		period := strings.TrimSpace(kv[0])
+		if _, ok := limits[period]; !ok {
+			return nil, fmt.Errorf("unknown period %q", period)
+		}
+
+		limit, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil || limit < -1 {
+			return nil, fmt.Errorf("invalid limit for %s: %q", period, kv[1])
+		}
+
+		ret[period] = limit
+	}
+
+	return ret, nil
+}
+
+type Usage struct {
+	period    string
+	key       string
+	limit     int64
+	remaining int64
+	record    counterRecord // as read along with cas, shared by the counters of the key
+	cas       uint32
+}
+
+func localPolicyIncrement(ctx *RateLimitingContext, counters map[string]Usage, ts *Timestamps) error {
+	var ret error
+
+	// Counters sharing a record are incremented in a single write
+	records := make(map[string][]Usage)
+	for _, usage := range counters {
+		records[usage.key] = append(records[usage.key], usage)
+	}
+
+	for key, usages := range records {
+		// Batched hits are written to the store on the next flush
+		if ctx.batch != nil {
+			// Requests are not counted while the store is full
+			if ctx.batch.full(key) {
+				ret = errStoreFull
+				continue
 			}
+			for _, u := range usages {
+				ctx.batch.add(key, u.period, ts, ctx.cost)
+			}
+			continue
 		}
-		if !saved {
-			proxywasm.LogErrorf("could not increment counter for period '%v': %v", period, err)
+
+		err := updateRecord(key, usages[0].record, usages[0].cas, func(rec *counterRecord) bool {
+			for _, u := range usages {
+				rec.add(u.period, ts.start[u.period], ctx.cost)
+			}
+			return true
+		})
+		if err != nil {
+			if err == errStoreFull {
+				storeFullCounter.Increment(1)
+				ret = err
+			}
+			proxywasm.LogErrorf("could not increment counters '%v': %v", key, err)
+		} else if ctx.cluster != nil {
+			for _, u := range usages {
+				ctx.cluster.record(key, u.period, ts.start[u.period], ts.end[u.period], ctx.cost)
+			}
 		}
 	}
+
+	return ret
 }
 
+// Counters are named after their period, prefixed for aggregate limits
+const aggregatePrefix = "aggregate_"
+
+// getUsage reads the counters of the identifier and, in the same pass, the
+// aggregate counters of all identifiers combined. It returns the name of a
+// counter over its limit, if any.
 func getUsage(ctx *RateLimitingContext, id Identifier, ts *Timestamps) (map[string]Usage, string, error) {
 	counters := make(map[string]Usage)
 	stop := ""
 
-	for period, limit := range *ctx.limits {
+	// Each record is read once for all its periods
+	type read struct {
+		record counterRecord
+		cas    uint32
+	}
+	records := make(map[string]read)
+
+	check := func(name string, period string, limit int64, key string, migrate func() counterRecord) error {
 		if limit == -1 {
-			continue
+			return nil
 		}
 
-		curUsage, cas, err := localPolicyUsage(ctx, id, period, ts)
-		if err != nil {
-			return counters, period, err
+		r, ok := records[key]
+		if !ok {
+			rec, cas, err := readRecordOrMigrate(key, migrate)
+			if err != nil {
+				return err
+			}
+			r = read{rec, cas}
+			records[key] = r
+		}
+
+		curUsage := r.record.get(period, ts.start[period])
+		if ctx.batch != nil {
+			curUsage += ctx.batch.unflushed(key, period, ts.start[period])
 		}
 
 		// What is the current usage for the configured limit name?
 		remaining := limit - int64(curUsage)
 
 		// Recording usage
-		counters[period] = Usage{
+		counters[name] = Usage{
+			period:    period,
+			key:       key,
 			limit:     limit,
 			remaining: remaining,
-			usage:     curUsage,
-			cas:       cas,
+			record:    r.record,
+			cas:       r.cas,
+		}
+
+		// Requests are rejected when their cost would exceed the limit
+		if remaining < ctx.cost {
+			stop = name
 		}
+		return nil
+	}
+
+	for period, limit := range *ctx.limits {
+		if err := check(period, period, limit, getLocalKey(ctx, id), getLegacyRecord(ctx, id, ts)); err != nil {
+			return counters, stop, err
+		}
+	}
 
-		if remaining <= 0 {
-			stop = period
+	for period, limit := range *ctx.aggregateLimits {
+		if err := check(aggregatePrefix+period, period, limit, getAggregateKey(ctx), nil); err != nil {
+			return counters, stop, err
 		}
 	}
 
 	return counters, stop, nil
 }
 
+func getReset(period string, ts *Timestamps) int64 {
+	return max(1, ts.end[period]-ts.now)
+}
+
+// Format of an HTTP-date as per RFC 9110, section 5.6.7
+const httpDateFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// getRetryDelay returns the seconds a rejected client should wait before
+// retrying, as told by Retry-After
+func getRetryDelay(conf *config.Config, reset int64) int64 {
+	retryAfter := reset
+	if conf.RetryAfterJitter > 0 {
+		// Spread retries so throttled clients don't all come back
+		// at the same second when the window resets
+		retryAfter += rand.Int63n(conf.RetryAfterJitter + 1)
+	}
+	return retryAfter
+}
+
+func getRetryAfter(conf *config.Config, now int64, retryAfter int64) string {
+	if conf.RetryAfterFormat == "http-date" {
+		return time.Unix(now+retryAfter, 0).UTC().Format(httpDateFormat)
+	}
+
+	return fmt.Sprintf("%d", retryAfter)
+}
+
 func processUsage(ctx *RateLimitingContext, counters map[string]Usage, stop string, ts *Timestamps) types.Action {
 	conf := ctx.conf
 	var headers map[string]string
 	reset := int64(0)
 
-	now := (*ts)["now"]
-	if !conf.HideClientHeaders {
+	now := ts.now
+	// Unlimited requests, such as of exempted gRPC methods, get no headers
+	if !conf.HideClientHeaders && len(counters) > 0 {
 		headers = make(map[string]string)
 		limit := int64(0)
 		window := int64(0)
@@ -281,11 +831,12 @@ func processUsage(ctx *RateLimitingContext, counters map[string]Usage, stop stri
 
 		for k, v := range counters {
 			curLimit := v.limit
-			curWindow := expiration[k]
+			curWindow := ts.end[v.period] - ts.start[v.period]
 			curRemaining := v.remaining
 
-			if stop == "" || stop == k {
-				curRemaining--
+			// Rejected requests are not counted
+			if stop == "" {
+				curRemaining -= ctx.cost
 			}
 			curRemaining = max(0, curRemaining)
 
@@ -297,11 +848,13 @@ func processUsage(ctx *RateLimitingContext, counters map[string]Usage, stop stri
 				window = curWindow
 				remaining = curRemaining
 
-				reset = max(1, window-(now-((*ts)[k])))
+				reset = getReset(v.period, ts)
 			}
 
-			headers[xRateLimitLimit[k]] = fmt.Sprintf("%d", curLimit)
-			headers[xRateLimitRemaining[k]] = fmt.Sprintf("%d", curRemaining)
+			if k == v.period {
+				headers[xRateLimitLimit[k]] = fmt.Sprintf("%d", curLimit)
+				headers[xRateLimitRemaining[k]] = fmt.Sprintf("%d", curRemaining)
+			}
 		}
 
 		headers["RateLimit-Limit"] = fmt.Sprintf("%d", limit)
@@ -319,12 +872,13 @@ func processUsage(ctx *RateLimitingContext, counters map[string]Usage, stop stri
 				}
 			}
 		}
-		pairs = append(pairs, [2]string{"Retry-After", fmt.Sprintf("%d", reset)})
+		retryDelay := getRetryDelay(conf, reset)
+		pairs = append(pairs, [2]string{"Retry-After", getRetryAfter(conf, now, retryDelay)})
 
-		if err := proxywasm.SendHttpResponse(429, pairs, []byte("Go informs: API rate limit exceeded!"), -1); err != nil {
-			panic(err)
+		if ctx.grpc {
+			return sendGrpcResponse(grpcResourceExhausted, "API rate limit exceeded", pairs, retryDelay)
 		}
-		return types.ActionPause
+		return sendHttpResponse(429, pairs, "Go informs: API rate limit exceeded!")
 	}
 	
 	if headers != nil {
@@ -334,52 +888,136 @@ func processUsage(ctx *RateLimitingContext, counters map[string]Usage, stop stri
 	return types.ActionContinue
 }
 
-func (ctx *RateLimitingContext) OnHttpRequestHeaders(numHeaders int, eof bool) types.Action {
-	ts := getTimestamps(time.Now())
+// sendHttpResponse replies to the client and stops the request. If the
+// response cannot be sent, the request is let through.
+func sendHttpResponse(status uint32, headers [][2]string, body string) types.Action {
+	if err := proxywasm.SendHttpResponse(status, headers, []byte(body), -1); err != nil {
+		proxywasm.LogErrorf("could not send %d response: %v", status, err)
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
 
-	// Consumer is identified by IP address
-	// TODO Add authenticated credential id support
-	id := getIdentifier(ctx.conf)
+// Rejects a request that cannot be checked or counted, when failing closed
+func sendFailure(ctx *RateLimitingContext) types.Action {
+	if ctx.grpc {
+		return sendGrpcResponse(grpcUnavailable, ctx.conf.FailureMessage, nil, 0)
+	}
+	return sendHttpResponse(uint32(ctx.conf.FailureCode), nil, ctx.conf.FailureMessage)
+}
+
+func rateLimit(ctx *RateLimitingContext, ts *Timestamps) types.Action {
+	id := ctx.id
 
 	counters, stop, err := getUsage(ctx, id, ts)
 	if err != nil {
+		proxywasm.LogErrorf("failed to get usage: %v", err)
+
 		if !ctx.conf.FaultTolerant {
-			panic(err)
+			return sendFailure(ctx)
 		}
-
-		proxywasm.LogErrorf("failed to get usage: %v", err)
+		// Counters which could not all be read tell nothing reliable
+		return types.ActionContinue
 	}
 
 	if counters != nil {
+		if stop != "" && ctx.throttle != nil {
+			u := counters[stop]
+			if ctx.throttle.hold(ctx, getReset(u.period, ts), ctx.cost-u.remaining, ts) {
+				return types.ActionPause
+			}
+		}
+
 		action := processUsage(ctx, counters, stop, ts)
 		if action != types.ActionContinue {
 			return action
 		}
 
-		localPolicyIncrement(ctx, id, counters, ts)
+		err = localPolicyIncrement(ctx, counters, ts)
+		if err == errStoreFull && ctx.conf.StoreFullPolicy == "fail_closed" {
+			return sendFailure(ctx)
+		}
 	}
 
 	return types.ActionContinue
 }
 
-func (ctx *RateLimitingContext) OnHttpResponseHeaders(numHeaders int, eof bool) types.Action {
-	if !eof {
-		return types.ActionContinue
+func (ctx *RateLimitingContext) OnHttpRequestHeaders(numHeaders int, eof bool) types.Action {
+	ts := getTimestamps(ctx.clock.Now().In(ctx.location))
+
+	// Consumer is identified by IP address
+	// TODO Add authenticated credential id support
+	ctx.id = getIdentifier(ctx.conf, ctx.properties)
+	ctx.scope = getScope(ctx)
+	grpc := isGrpcRequest()
+	ctx.grpc = grpc && ctx.conf.GrpcMode == "auto"
+
+	// Methods with limits of their own, such as writes, replace the
+	// limits of the route
+	method, err := proxywasm.GetHttpRequestHeader(":method")
+	if err == nil {
+		if limits, ok := (*ctx.methodLimits)[method]; ok {
+			ctx.method = method
+			ctx.limits = &limits
+		}
+	}
+
+	// gRPC services and methods with limits of their own replace the
+	// limits of the HTTP method, which is always POST
+	if grpc {
+		if name, limits, ok := getGrpcMethodLimits(*ctx.grpcMethodLimits); ok {
+			// Services and methods listed without limits, such as health
+			// checks, are exempt from aggregate limits as well
+			if unlimited(limits) {
+				return types.ActionContinue
+			}
+			ctx.method = ""
+			ctx.rpc = name
+			ctx.limits = &limits
+		}
 	}
+
+	if override := getLimitsOverride(ctx.conf, ctx.properties, ctx.id, ts); override != "" {
+		limits, err := overrideLimits(*ctx.limits, override)
+		if err != nil {
+			proxywasm.LogWarnf("ignoring limits override: %v", err)
+		} else {
+			ctx.limits = &limits
+		}
+	}
+
+	// GraphQL operations are only known once the body has been read
+	if ctx.conf.GraphQL {
+		return onGraphQLRequestHeaders(ctx, ts, eof)
+	}
+
+	return rateLimit(ctx, ts)
+}
+
+func (ctx *RateLimitingContext) OnHttpResponseHeaders(numHeaders int, eof bool) types.Action {
 	if ctx.headers != nil {
 		pairs, err := proxywasm.GetHttpResponseHeaders()
 		if err != nil {
-			panic(err)
+			proxywasm.LogErrorf("could not get response headers: %v", err)
+			return types.ActionContinue
 		}
 		for k, v := range ctx.headers {
 			pairs = append(pairs, [2]string{k, v})
 		}
-		proxywasm.ReplaceHttpResponseHeaders(pairs)
+		if err := proxywasm.ReplaceHttpResponseHeaders(pairs); err != nil {
+			proxywasm.LogErrorf("could not set rate limiting headers: %v", err)
+		}
 	}
 
 	return types.ActionContinue
 }
 
+func (ctx *RateLimitingContext) OnHttpStreamDone() {
+	if ctx.throttle != nil {
+		ctx.throttle.release(ctx)
+	}
+}
+
 func main() {
 	proxywasm.SetVMContext(&VMContext{})
 }
@@ -0,0 +1,1904 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kong/proxy-wasm-go-rate-limiting/config"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// -----------------------------------------------------------------------------
+// Helpers
+// -----------------------------------------------------------------------------
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// All tests start at the same instant unless they set the clock themselves
+var testTime = time.Date(2023, time.March, 15, 10, 20, 30, 0, time.UTC)
+
+// Properties of the host, which the host emulator does not provide
+type fakeProperties map[string]string
+
+func (p fakeProperties) get(path []string) ([]byte, error) {
+	value, ok := p[strings.Join(path, ".")]
+	if !ok {
+		return nil, types.ErrorStatusNotFound
+	}
+	return []byte(value), nil
+}
+
+func newTestProperties() fakeProperties {
+	return fakeProperties{
+		"kong.route_id":   "route-1",
+		"kong.service_id": "service-1",
+		"ngx.remote_addr": "10.0.0.1",
+	}
+}
+
+// Key of the counters of requests made with the test properties
+func getTestKey() string {
+	return getLocalKey(&RateLimitingContext{conf: &config.Config{}, scope: "route:route-1:service-1"}, "10.0.0.1")
+}
+
+func startPlugin(t *testing.T, conf string) (proxytest.HostEmulator, *fakeClock) {
+	t.Helper()
+
+	return startPluginWithProperties(t, conf, newTestProperties())
+}
+
+func startPluginWithProperties(t *testing.T, conf string, props fakeProperties) (proxytest.HostEmulator, *fakeClock) {
+	t.Helper()
+
+	clock := &fakeClock{now: testTime}
+	opt := proxytest.NewEmulatorOption().
+		WithVMContext(&VMContext{clock: clock, getProperty: props.get}).
+		WithPluginConfiguration([]byte(conf))
+	host, reset := proxytest.NewHostEmulator(opt)
+	t.Cleanup(reset)
+
+	if status := host.StartPlugin(); status != types.OnPluginStartStatusOK {
+		t.Fatalf("plugin failed to start with configuration %s", conf)
+	}
+
+	return host, clock
+}
+
+// doRequest runs a request through the filter, and through the response
+// phase as well if the request was let through.
+func doRequest(host proxytest.HostEmulator, headers [][2]string) (uint32, types.Action) {
+	id := host.InitializeHttpContext()
+
+	action := host.CallOnRequestHeaders(id, headers, false)
+	if action == types.ActionContinue {
+		host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}}, false)
+	}
+
+	return id, action
+}
+
+func getHeader(headers [][2]string, name string) (string, bool) {
+	for _, h := range headers {
+		if strings.EqualFold(h[0], name) {
+			return h[1], true
+		}
+	}
+	return "", false
+}
+
+func checkHeader(t *testing.T, headers [][2]string, name string, expected string) {
+	t.Helper()
+
+	value, ok := getHeader(headers, name)
+	if !ok {
+		t.Errorf("missing header %s", name)
+	} else if value != expected {
+		t.Errorf("header %s: expected %q, got %q", name, expected, value)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Plugin Context
+// -----------------------------------------------------------------------------
+
+func TestPluginStartInvalidConfig(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().
+		WithVMContext(&VMContext{}).
+		WithPluginConfiguration([]byte(`{"minute": "ten"}`))
+	host, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	if status := host.StartPlugin(); status != types.OnPluginStartStatusFailed {
+		t.Errorf("expected plugin start to fail, got %v", status)
+	}
+	if len(host.GetCriticalLogs()) == 0 {
+		t.Errorf("expected configuration error to be logged")
+	}
+}
+
+func TestPluginStartInvalidConfigValues(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().
+		WithVMContext(&VMContext{}).
+		WithPluginConfiguration([]byte(`{"minute": 1, "limit_by": "header"}`))
+	host, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	if status := host.StartPlugin(); status != types.OnPluginStartStatusFailed {
+		t.Errorf("expected plugin start to fail, got %v", status)
+	}
+
+	logs := host.GetCriticalLogs()
+	if len(logs) == 0 || !strings.Contains(logs[0], "header_name is required") {
+		t.Errorf("expected the problem to be logged, got %v", logs)
+	}
+}
+
+func TestPluginStartInvalidTimezone(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().
+		WithVMContext(&VMContext{}).
+		WithPluginConfiguration([]byte(`{"day": 1, "timezone": "Mars/Olympus_Mons"}`))
+	host, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	if status := host.StartPlugin(); status != types.OnPluginStartStatusFailed {
+		t.Errorf("expected plugin start to fail, got %v", status)
+	}
+}
+
+func TestPluginStartThrottleTick(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "throttle": true}`)
+
+	if host.GetTickPeriod() != throttleTickPeriod {
+		t.Errorf("expected tick period %d, got %d", throttleTickPeriod, host.GetTickPeriod())
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Rate Limiting Context
+// -----------------------------------------------------------------------------
+
+func TestRequestsWithinLimit(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3}`)
+
+	for i := 0; i < 3; i++ {
+		id, action := doRequest(host, nil)
+		if action != types.ActionContinue {
+			t.Fatalf("request %d: expected to continue, got %v", i+1, action)
+		}
+
+		headers := host.GetCurrentResponseHeaders(id)
+		remaining := strconv.Itoa(2 - i)
+		checkHeader(t, headers, "X-RateLimit-Limit-Minute", "3")
+		checkHeader(t, headers, "X-RateLimit-Remaining-Minute", remaining)
+		checkHeader(t, headers, "RateLimit-Limit", "3")
+		checkHeader(t, headers, "RateLimit-Remaining", remaining)
+		if _, ok := getHeader(headers, "RateLimit-Reset"); !ok {
+			t.Errorf("missing header RateLimit-Reset")
+		}
+	}
+}
+
+func TestRequestOverLimit(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 2}`)
+
+	doRequest(host, nil)
+	doRequest(host, nil)
+	id, action := doRequest(host, nil)
+	if action != types.ActionPause {
+		t.Fatalf("expected request over the limit to pause, got %v", action)
+	}
+
+	resp := host.GetSentLocalResponse(id)
+	if resp == nil {
+		t.Fatalf("expected a local response")
+	}
+	if resp.StatusCode != 429 {
+		t.Errorf("expected status 429, got %d", resp.StatusCode)
+	}
+	checkHeader(t, resp.Headers, "X-RateLimit-Remaining-Minute", "0")
+	checkHeader(t, resp.Headers, "RateLimit-Remaining", "0")
+
+	retryAfter, ok := getHeader(resp.Headers, "Retry-After")
+	if !ok {
+		t.Fatalf("missing header Retry-After")
+	}
+	if retryAfter != "30" {
+		t.Errorf("expected Retry-After at the end of the minute, got %q", retryAfter)
+	}
+}
+
+func TestMostRestrictiveLimit(t *testing.T) {
+	host, _ := startPlugin(t, `{"second": 100, "minute": 5, "hour": 10}`)
+
+	id, _ := doRequest(host, nil)
+
+	headers := host.GetCurrentResponseHeaders(id)
+	checkHeader(t, headers, "X-RateLimit-Limit-Second", "100")
+	checkHeader(t, headers, "X-RateLimit-Limit-Minute", "5")
+	checkHeader(t, headers, "X-RateLimit-Limit-Hour", "10")
+	checkHeader(t, headers, "RateLimit-Limit", "5")
+	checkHeader(t, headers, "RateLimit-Remaining", "4")
+}
+
+func TestHideClientHeaders(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "hide_client_headers": true}`)
+
+	id, _ := doRequest(host, nil)
+	for _, h := range host.GetCurrentResponseHeaders(id) {
+		if strings.HasPrefix(strings.ToLower(h[0]), "x-ratelimit") ||
+			strings.HasPrefix(strings.ToLower(h[0]), "ratelimit") {
+			t.Errorf("unexpected header %s", h[0])
+		}
+	}
+
+	id, _ = doRequest(host, nil)
+	resp := host.GetSentLocalResponse(id)
+	if resp == nil || resp.StatusCode != 429 {
+		t.Fatalf("expected a 429 response")
+	}
+	if _, ok := getHeader(resp.Headers, "RateLimit-Limit"); ok {
+		t.Errorf("unexpected header RateLimit-Limit")
+	}
+	if _, ok := getHeader(resp.Headers, "Retry-After"); !ok {
+		t.Errorf("missing header Retry-After")
+	}
+}
+
+func TestLimitByHeader(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "limit_by": "header", "header_name": "x_consumer"}`)
+
+	alice := [][2]string{{"x_consumer", "alice"}}
+	bob := [][2]string{{"x_consumer", "bob"}}
+
+	if _, action := doRequest(host, alice); action != types.ActionContinue {
+		t.Errorf("expected first request by alice to continue")
+	}
+	if _, action := doRequest(host, bob); action != types.ActionContinue {
+		t.Errorf("expected first request by bob to continue")
+	}
+	if _, action := doRequest(host, alice); action != types.ActionPause {
+		t.Errorf("expected second request by alice to be rejected")
+	}
+}
+
+func TestAggregateLimit(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 2, "aggregate": {"minute": 3}, "limit_by": "header", "header_name": "x_consumer"}`)
+
+	alice := [][2]string{{"x_consumer", "alice"}}
+	bob := [][2]string{{"x_consumer", "bob"}}
+	carol := [][2]string{{"x_consumer", "carol"}}
+
+	doRequest(host, alice)
+	doRequest(host, bob)
+	id, action := doRequest(host, alice)
+	if action != types.ActionContinue {
+		t.Fatalf("expected requests under both limits to continue")
+	}
+
+	// Per-identifier headers are not mixed with aggregate counters
+	headers := host.GetCurrentResponseHeaders(id)
+	checkHeader(t, headers, "X-RateLimit-Remaining-Minute", "0")
+	checkHeader(t, headers, "RateLimit-Remaining", "0")
+
+	id, action = doRequest(host, carol)
+	if action != types.ActionPause {
+		t.Fatalf("expected first request by carol to be rejected by the aggregate limit")
+	}
+	resp := host.GetSentLocalResponse(id)
+	if resp == nil || resp.StatusCode != 429 {
+		t.Fatalf("expected a 429 response")
+	}
+	checkHeader(t, resp.Headers, "X-RateLimit-Remaining-Minute", "2")
+	checkHeader(t, resp.Headers, "RateLimit-Limit", "3")
+	checkHeader(t, resp.Headers, "RateLimit-Remaining", "0")
+}
+
+func TestMethodLimits(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3, "methods": {"POST": {"minute": 1}}}`)
+
+	get := [][2]string{{":method", "GET"}}
+	post := [][2]string{{":method", "POST"}}
+
+	id, action := doRequest(host, post)
+	if action != types.ActionContinue {
+		t.Fatalf("expected first POST to continue")
+	}
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "X-RateLimit-Limit-Minute", "1")
+
+	if _, action := doRequest(host, post); action != types.ActionPause {
+		t.Errorf("expected second POST to be rejected")
+	}
+
+	// Reads are counted apart from writes
+	id, action = doRequest(host, get)
+	if action != types.ActionContinue {
+		t.Fatalf("expected GET to continue")
+	}
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "X-RateLimit-Remaining-Minute", "2")
+}
+
+func TestLimitByPath(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "limit_by": "path", "path": "/limited"}`)
+
+	limited := [][2]string{{":path", "/limited"}}
+	other := [][2]string{{":path", "/other"}}
+
+	if _, action := doRequest(host, limited); action != types.ActionContinue {
+		t.Errorf("expected first request to /limited to continue")
+	}
+	if _, action := doRequest(host, other); action != types.ActionContinue {
+		t.Errorf("expected first request to /other to continue")
+	}
+	if _, action := doRequest(host, limited); action != types.ActionPause {
+		t.Errorf("expected second request to /limited to be rejected")
+	}
+}
+
+func TestRetryAfterHttpDate(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "retry_after_format": "http-date"}`)
+
+	doRequest(host, nil)
+	id, _ := doRequest(host, nil)
+
+	resp := host.GetSentLocalResponse(id)
+	if resp == nil {
+		t.Fatalf("expected a local response")
+	}
+	checkHeader(t, resp.Headers, "Retry-After", "Wed, 15 Mar 2023 10:21:00 GMT")
+}
+
+func TestRetryAfterJitter(t *testing.T) {
+	host, _ := startPlugin(t, `{"day": 1, "retry_after_jitter": 30}`)
+
+	doRequest(host, nil)
+	id, _ := doRequest(host, nil)
+
+	resp := host.GetSentLocalResponse(id)
+	if resp == nil {
+		t.Fatalf("expected a local response")
+	}
+	reset, _ := getHeader(resp.Headers, "RateLimit-Reset")
+	retryAfter, _ := getHeader(resp.Headers, "Retry-After")
+	r, _ := strconv.Atoi(reset)
+	n, _ := strconv.Atoi(retryAfter)
+	if n < r || n > r+30 {
+		t.Errorf("expected Retry-After between %d and %d, got %d", r, r+30, n)
+	}
+}
+
+const overrideConf = `{"minute": 1, "limits_override_header": "X-Plan-Limits", "limits_override_secret": "0123456789abcdef"}`
+
+// signedOverride returns the header value of limits signed for the client
+// of the test properties, expiring in an hour
+func signedOverride(limits string) string {
+	return signOverride("10.0.0.1", limits, testTime.Unix()+3600)
+}
+
+func signOverride(id Identifier, limits string, expires int64) string {
+	return fmt.Sprintf("%s;exp=%d;sig=%s", limits, expires,
+		signLimitsOverride("0123456789abcdef", id, limits, expires))
+}
+
+func TestLimitsOverrideHeader(t *testing.T) {
+	host, _ := startPlugin(t, overrideConf)
+
+	plan := [][2]string{{"X-Plan-Limits", signedOverride("minute=3, hour=100")}}
+	for i := 0; i < 3; i++ {
+		id, action := doRequest(host, plan)
+		if action != types.ActionContinue {
+			t.Fatalf("request %d: expected to continue under the overridden limit", i+1)
+		}
+		if _, ok := getHeader(host.GetCurrentRequestHeaders(id), "X-Plan-Limits"); ok {
+			t.Errorf("expected override header to be removed from the request")
+		}
+
+		headers := host.GetCurrentResponseHeaders(id)
+		checkHeader(t, headers, "X-RateLimit-Limit-Minute", "3")
+		checkHeader(t, headers, "X-RateLimit-Limit-Hour", "100")
+	}
+
+	if _, action := doRequest(host, plan); action != types.ActionPause {
+		t.Errorf("expected request over the overridden limit to be rejected")
+	}
+}
+
+func TestLimitsOverrideUnsigned(t *testing.T) {
+	for _, value := range []string{
+		"minute=1000000",
+		fmt.Sprintf("minute=1000000;exp=%d;sig=%s", testTime.Unix()+3600, strings.Repeat("0", 64)),
+		// Signed for another client
+		signOverride("10.0.0.2", "minute=1000000", testTime.Unix()+3600),
+		// Signed for other limits
+		strings.Replace(signedOverride("minute=2"), "minute=2", "minute=1000000", 1),
+		// Signed for another expiry
+		strings.Replace(signedOverride("minute=1000000"), fmt.Sprint(testTime.Unix()+3600), fmt.Sprint(testTime.Unix()+7200), 1),
+		// Signed without an expiry
+		"minute=1000000;sig=" + signLimitsOverride("0123456789abcdef", "10.0.0.1", "minute=1000000", 0),
+	} {
+		t.Run(value, func(t *testing.T) {
+			host, _ := startPlugin(t, overrideConf)
+
+			plan := [][2]string{{"X-Plan-Limits", value}}
+			doRequest(host, plan)
+			if _, action := doRequest(host, plan); action != types.ActionPause {
+				t.Errorf("expected the configured limit to apply with %q", value)
+			}
+		})
+	}
+}
+
+func TestLimitsOverrideExpired(t *testing.T) {
+	host, clock := startPlugin(t, overrideConf)
+
+	plan := [][2]string{{"X-Plan-Limits", signOverride("10.0.0.1", "minute=1000000", testTime.Unix()+60)}}
+	for i := 0; i < 2; i++ {
+		if _, action := doRequest(host, plan); action != types.ActionContinue {
+			t.Fatalf("expected request %d to continue before the override expires", i+1)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	doRequest(host, plan)
+	if _, action := doRequest(host, plan); action != types.ActionPause {
+		t.Errorf("expected the configured limit to apply once the override expired")
+	}
+	if len(host.GetWarnLogs()) == 0 {
+		t.Errorf("expected the expired override to be logged")
+	}
+}
+
+func TestLimitsOverrideInvalid(t *testing.T) {
+	host, _ := startPlugin(t, overrideConf)
+
+	plan := [][2]string{{"X-Plan-Limits", signedOverride("minute=lots")}}
+	doRequest(host, plan)
+	if _, action := doRequest(host, plan); action != types.ActionPause {
+		t.Errorf("expected configured limit to apply")
+	}
+	if len(host.GetWarnLogs()) == 0 {
+		t.Errorf("expected invalid override to be logged")
+	}
+}
+
+func TestOverrideLimits(t *testing.T) {
+	limits := map[string]int64{"second": -1, "minute": 10, "hour": 100}
+
+	ret, err := overrideLimits(limits, "second=1,minute=-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ret["second"] != 1 || ret["minute"] != -1 || ret["hour"] != 100 {
+		t.Errorf("unexpected limits %v", ret)
+	}
+	if limits["minute"] != 10 {
+		t.Errorf("expected configured limits to be left unchanged")
+	}
+
+	for _, override := range []string{"minute", "week=1", "minute=-2", "minute=1.5"} {
+		if _, err := overrideLimits(limits, override); err == nil {
+			t.Errorf("expected %q to be rejected", override)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Scope
+// -----------------------------------------------------------------------------
+
+func TestScope(t *testing.T) {
+	for _, tc := range []struct {
+		scope  string
+		shared map[string]string // properties changed for a request counted along
+		apart  map[string]string // properties changed for a request counted apart
+	}{
+		{"route", map[string]string{"ngx.remote_addr": "10.0.0.1"}, map[string]string{"kong.route_id": "route-2"}},
+		{"service", map[string]string{"kong.route_id": "route-2"}, map[string]string{"kong.service_id": "service-2"}},
+		{"global", map[string]string{"kong.service_id": "service-2"}, nil},
+		{"filter_instance", map[string]string{"kong.service_id": "service-2"}, nil},
+	} {
+		t.Run(tc.scope, func(t *testing.T) {
+			props := newTestProperties()
+			host, _ := startPluginWithProperties(t, `{"minute": 1, "scope": "`+tc.scope+`"}`, props)
+
+			doRequest(host, nil)
+
+			for k, v := range tc.shared {
+				props[k] = v
+			}
+			if _, action := doRequest(host, nil); action != types.ActionPause {
+				t.Errorf("expected request in the same %s to be rejected", tc.scope)
+			}
+
+			for k, v := range tc.apart {
+				props[k] = v
+			}
+			if tc.apart != nil {
+				if _, action := doRequest(host, nil); action != types.ActionContinue {
+					t.Errorf("expected request in another %s to continue", tc.scope)
+				}
+			}
+		})
+	}
+}
+
+func TestScopeEnvoyProperties(t *testing.T) {
+	props := fakeProperties{"xds.route_name": "route-1", "xds.cluster_name": "cluster-1"}
+	host, _ := startPluginWithProperties(t, `{"minute": 1}`, props)
+
+	doRequest(host, nil)
+	props["xds.route_name"] = "route-2"
+	if _, action := doRequest(host, nil); action != types.ActionContinue {
+		t.Errorf("expected routes to be told apart from Envoy attributes")
+	}
+}
+
+func TestEnvoySourceAddress(t *testing.T) {
+	props := fakeProperties{"xds.route_name": "route-1", "source.address": "10.0.0.1:50000"}
+	host, _ := startPluginWithProperties(t, `{"minute": 1}`, props)
+
+	doRequest(host, nil)
+
+	// Requests from the same address and another port come from the same client
+	props["source.address"] = "10.0.0.1:50001"
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Errorf("expected second request from the same address to be rejected")
+	}
+
+	props["source.address"] = "[2001:db8::1]:50000"
+	if _, action := doRequest(host, nil); action != types.ActionContinue {
+		t.Errorf("expected request from another address to continue")
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"10.0.0.1":            "10.0.0.1",
+		"10.0.0.1:8000":       "10.0.0.1",
+		"2001:db8::1":         "2001:db8::1",
+		"[2001:db8::1]:50000": "2001:db8::1",
+	} {
+		if ip := stripPort(addr); ip != expected {
+			t.Errorf("expected %q for %q, got %q", expected, addr, ip)
+		}
+	}
+}
+
+func TestConfiguredHost(t *testing.T) {
+	props := newTestProperties()
+	props["xds.route_name"] = "route-1"
+	props["source.address"] = "10.0.0.2:50000"
+	host, _ := startPluginWithProperties(t, `{"minute": 1, "host": "envoy"}`, props)
+
+	doRequest(host, nil)
+
+	// Kong properties are ignored on Envoy
+	props["kong.route_id"] = "route-2"
+	props["ngx.remote_addr"] = "10.0.0.3"
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Errorf("expected requests to be identified from Envoy attributes only")
+	}
+}
+
+func TestScopeMissingProperties(t *testing.T) {
+	host, _ := startPluginWithProperties(t, `{"minute": 1}`, fakeProperties{})
+
+	doRequest(host, nil)
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Errorf("expected requests to be counted in the filter_instance scope")
+	}
+
+	warnings := 0
+	for _, log := range host.GetWarnLogs() {
+		if strings.Contains(log, "route id is not available") {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("expected the missing route id to be logged once, got %d times", warnings)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Counters
+// -----------------------------------------------------------------------------
+
+func TestRecordExpiredWindow(t *testing.T) {
+	var rec counterRecord
+	rec.add("minute", 60, 42)
+	rec.add("hour", 0, 7)
+	buf := rec.encode()
+
+	if len(buf) != recordSize || buf[0] != recordVersion {
+		t.Fatalf("unexpected record layout %v", buf)
+	}
+
+	rec = decodeRecord(buf)
+	if v := rec.get("minute", 60); v != 42 {
+		t.Errorf("expected 42 in the current window, got %d", v)
+	}
+	if v := rec.get("minute", 120); v != 0 {
+		t.Errorf("expected 0 in a later window, got %d", v)
+	}
+	if v := rec.get("hour", 0); v != 7 {
+		t.Errorf("expected other periods to be kept, got %d", v)
+	}
+
+	rec.add("minute", 120, 1)
+	if v := rec.get("minute", 120); v != 1 {
+		t.Errorf("expected the counter to restart in a later window, got %d", v)
+	}
+	rec.add("minute", 60, 1)
+	if v := rec.get("minute", 120); v != 1 {
+		t.Errorf("expected hits of an earlier window to be dropped, got %d", v)
+	}
+
+	rec = decodeRecord([]byte{1, 2, 3})
+	if v := rec.get("minute", 60); v != 0 {
+		t.Errorf("expected 0 for a malformed record, got %d", v)
+	}
+}
+
+func setLegacyCounter(t *testing.T, period string, hits uint64) {
+	t.Helper()
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, hits)
+	key := getLegacyKey("10.0.0.1", period, getTimestamps(testTime))
+	_, cas, _ := proxywasm.GetSharedData(key)
+	if err := proxywasm.SetSharedData(key, buf, cas); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordMigration(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3, "hour": 10}`)
+	ts := getTimestamps(testTime)
+
+	// Counters left by a version of the filter storing one per period and
+	// window, the one of the previous minute being ignored
+	setLegacyCounter(t, "minute", 2)
+	setLegacyCounter(t, "hour", 5)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, 3)
+	previous := fmt.Sprintf("%s:::10.0.0.1:%d:minute", legacyKeyPrefix, ts.start["minute"]-60)
+	if err := proxywasm.SetSharedData(previous, buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := doRequest(host, nil)
+	headers := host.GetCurrentResponseHeaders(id)
+	checkHeader(t, headers, "X-RateLimit-Remaining-Minute", "0")
+	checkHeader(t, headers, "X-RateLimit-Remaining-Hour", "4")
+
+	value, _, err := proxywasm.GetSharedData(getTestKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := decodeRecord(value)
+	if v := rec.get("minute", ts.start["minute"]); v != 3 {
+		t.Errorf("expected the migrated record to hold 3 hits, got %d", v)
+	}
+	if v := rec.get("hour", ts.start["hour"]); v != 6 {
+		t.Errorf("expected the migrated record to hold 6 hits, got %d", v)
+	}
+}
+
+func TestRecordMigrationOverLimit(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3}`)
+	setLegacyCounter(t, "minute", 3)
+
+	// No record is written for rejected requests: the migrated one is
+	// remembered rather than read again
+	for i := 0; i < 2; i++ {
+		if _, action := doRequest(host, nil); action != types.ActionPause {
+			t.Fatalf("expected request %d over the migrated limit to be rejected", i+1)
+		}
+		setLegacyCounter(t, "minute", 0)
+	}
+}
+
+func TestRecordMigrationNamespaced(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3, "counters_namespace": "edge"}`)
+	setLegacyCounter(t, "minute", 3)
+
+	if _, action := doRequest(host, nil); action != types.ActionContinue {
+		t.Errorf("expected namespaced counters to start afresh")
+	}
+}
+
+func TestCounterKeys(t *testing.T) {
+	ctx := &RateLimitingContext{conf: &config.Config{}, scope: "route:route-1:service-1"}
+
+	short := getLocalKey(ctx, "alice@example.com")
+	long := getLocalKey(ctx, Identifier(strings.Repeat("x", 4096)))
+	if len(short) != len(long) {
+		t.Errorf("expected keys of a fixed length, got %q and %q", short, long)
+	}
+	if strings.Contains(short, "alice") {
+		t.Errorf("expected the identifier not to appear in key %q", short)
+	}
+	if short == getLocalKey(ctx, "bob@example.com") || short == getAggregateKey(ctx) {
+		t.Errorf("expected distinct keys")
+	}
+
+	ctx.namespace = "edge"
+	if short == getLocalKey(ctx, "alice@example.com") {
+		t.Errorf("expected namespaces to separate counters")
+	}
+}
+
+func TestResetCountersOnChange(t *testing.T) {
+	load := func(data string) string {
+		var conf config.Config
+		if err := config.Load([]byte(data), &conf); err != nil {
+			t.Fatal(err)
+		}
+		return getNamespace(&conf)
+	}
+
+	if ns := load(`{"minute": 5, "counters_namespace": "edge"}`); ns != "edge" {
+		t.Errorf("expected namespace to be kept as is, got %q", ns)
+	}
+
+	ns := load(`{"minute": 5, "reset_counters_on_change": true}`)
+	if ns != load(`{"minute": 5, "reset_counters_on_change": true, "hide_client_headers": true}`) {
+		t.Errorf("expected counters to be kept when limits do not change")
+	}
+	for _, data := range []string{
+		`{"minute": 6, "reset_counters_on_change": true}`,
+		`{"minute": 5, "aggregate": {"minute": 50}, "reset_counters_on_change": true}`,
+		`{"minute": 5, "methods": {"POST": {"minute": 1}}, "reset_counters_on_change": true}`,
+		`{"minute": 5, "limit_by": "header", "header_name": "x_consumer", "reset_counters_on_change": true}`,
+	} {
+		if load(data) == ns {
+			t.Errorf("expected counters to be reset with %s", data)
+		}
+	}
+}
+
+func TestLocalPolicyIncrementCasContention(t *testing.T) {
+	startPlugin(t, `{"minute": 10}`)
+
+	ctx := &RateLimitingContext{conf: &config.Config{}, id: "contended", cost: 1}
+	ts := getTimestamps(testTime)
+	key := getLocalKey(ctx, ctx.id)
+	counters := map[string]Usage{
+		"minute": {period: "minute", key: key, limit: 10},
+		"hour":   {period: "hour", key: key, limit: 100},
+	}
+
+	// Another worker counts hits after usage was read by this one
+	var rec counterRecord
+	rec.add("minute", ts.start["minute"], 5)
+	rec.add("hour", ts.start["hour"], 5)
+	if err := proxywasm.SetSharedData(key, rec.encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := localPolicyIncrement(ctx, counters, ts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value, _, err := proxywasm.GetSharedData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = decodeRecord(value)
+	if v := rec.get("minute", ts.start["minute"]); v != 6 {
+		t.Errorf("expected minute counter to be 6 after CAS retry, got %d", v)
+	}
+	if v := rec.get("hour", ts.start["hour"]); v != 6 {
+		t.Errorf("expected hour counter to be 6 after CAS retry, got %d", v)
+	}
+}
+
+func TestCountersSharedAcrossContexts(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 5}`)
+
+	for i := 0; i < 3; i++ {
+		doRequest(host, nil)
+	}
+
+	id, _ := doRequest(host, nil)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "X-RateLimit-Remaining-Minute", "1")
+}
+
+func TestCounterSlots(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "limit_by": "header", "header_name": "x_consumer", "counter_slots": 1}`)
+
+	request := func(name string) types.Action {
+		_, action := doRequest(host, [][2]string{{"x_consumer", name}})
+		return action
+	}
+
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		if request(name) != types.ActionContinue {
+			t.Fatalf("expected first request by %s to continue", name)
+		}
+	}
+	if request("alice") != types.ActionPause {
+		t.Errorf("expected second request by alice to be rejected")
+	}
+
+	// Alice is the least recently counted when the slot is full
+	if request("erin") != types.ActionContinue {
+		t.Errorf("expected first request by erin to continue")
+	}
+	if n, _ := host.GetCounterMetric("rate_limiting_evictions"); n != 1 {
+		t.Errorf("expected 1 eviction, got %d", n)
+	}
+	if request("bob") != types.ActionPause {
+		t.Errorf("expected second request by bob to be rejected")
+	}
+	if request("alice") != types.ActionContinue {
+		t.Errorf("expected alice to start afresh once evicted")
+	}
+}
+
+func TestCounterSlotsFull(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "limit_by": "header", "header_name": "x_consumer", "counter_slots": 1}`)
+
+	doRequest(host, [][2]string{{"x_consumer", "alice"}})
+	fillStore(t)
+
+	// Slots are allocated once, whatever the identifiers they hold
+	for _, name := range []string{"bob", "carol", "dave", "erin"} {
+		doRequest(host, [][2]string{{"x_consumer", name}})
+	}
+	if n, _ := host.GetCounterMetric("rate_limiting_store_full"); n != 0 {
+		t.Errorf("expected the store full metric to be 0, got %d", n)
+	}
+	if _, action := doRequest(host, [][2]string{{"x_consumer", "erin"}}); action != types.ActionPause {
+		t.Errorf("expected second request by erin to be rejected")
+	}
+}
+
+func TestSlotKeys(t *testing.T) {
+	ctx := &RateLimitingContext{conf: &config.Config{CounterSlots: 1}, scope: "global"}
+
+	alice := getLocalKey(ctx, "alice")
+	bob := getLocalKey(ctx, "bob")
+	slot, owner, ok := splitSlotKey(alice)
+	if !ok || owner == 0 || alice == bob {
+		t.Fatalf("expected distinct records in a slot, got %q and %q", alice, bob)
+	}
+	if other, _, _ := splitSlotKey(bob); other != slot {
+		t.Errorf("expected a single slot, got %q and %q", slot, other)
+	}
+	if _, _, ok := splitSlotKey(getAggregateKey(ctx)); ok {
+		t.Errorf("expected aggregate counters to have a key of their own")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Store Failures
+// -----------------------------------------------------------------------------
+
+// failReads makes reads from the store fail until the test ends
+func failReads(t *testing.T) {
+	storeReadError = types.ErrorStatusBadArgument
+	t.Cleanup(func() { storeReadError = nil })
+}
+
+func TestFaultTolerantReadFailure(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1}`)
+	failReads(t)
+
+	for i := 0; i < 3; i++ {
+		id, action := doRequest(host, nil)
+		if action != types.ActionContinue || host.GetSentLocalResponse(id) != nil {
+			t.Fatalf("expected request %d to pass when counters cannot be read", i+1)
+		}
+	}
+}
+
+func TestReadFailureFailsClosed(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "fault_tolerant": false}`)
+	failReads(t)
+
+	id, _ := doRequest(host, nil)
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 503 {
+		t.Fatalf("expected a 503 response when counters cannot be read")
+	}
+}
+
+func TestConnectionReadFailure(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "protocol": "tcp"}`)
+	failReads(t)
+
+	for i := 0; i < 3; i++ {
+		if _, action := host.InitializeConnection(); action != types.ActionContinue {
+			t.Fatalf("expected connection %d to be accepted when counters cannot be read", i+1)
+		}
+	}
+}
+
+// fillStore makes the store unable to hold more keys until the test ends
+func fillStore(t *testing.T) {
+	storeFull = true
+	t.Cleanup(func() { storeFull = false })
+}
+
+func TestStoreFull(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1}`)
+	fillStore(t)
+
+	for i := 0; i < 3; i++ {
+		id, action := doRequest(host, nil)
+		if action != types.ActionContinue || host.GetSentLocalResponse(id) != nil {
+			t.Fatalf("expected request %d to pass uncounted when the store is full", i+1)
+		}
+	}
+
+	if n, err := host.GetCounterMetric("rate_limiting_store_full"); err != nil || n != 3 {
+		t.Errorf("expected the store full metric to be 3, got %d (%v)", n, err)
+	}
+}
+
+func TestStoreFullFailsClosed(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 5, "store_full_policy": "fail_closed"}`)
+	fillStore(t)
+
+	id, _ := doRequest(host, nil)
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 503 {
+		t.Fatalf("expected a 503 response when the store is full")
+	}
+	if n, _ := host.GetCounterMetric("rate_limiting_store_full"); n != 1 {
+		t.Errorf("expected the store full metric to be 1, got %d", n)
+	}
+}
+
+func TestStoreFullExistingRecord(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 2, "store_full_policy": "fail_closed"}`)
+
+	doRequest(host, nil)
+	fillStore(t)
+
+	// Records are rewritten in place, which a full store still allows
+	id, _ := doRequest(host, nil)
+	if resp := host.GetSentLocalResponse(id); resp != nil {
+		t.Fatalf("expected the request to be counted, got a %d response", resp.StatusCode)
+	}
+	id, _ = doRequest(host, nil)
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 429 {
+		t.Fatalf("expected the request over the limit to be rejected")
+	}
+	if n, _ := host.GetCounterMetric("rate_limiting_store_full"); n != 0 {
+		t.Errorf("expected the store full metric to be 0, got %d", n)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Windows
+// -----------------------------------------------------------------------------
+
+func TestWindowReset(t *testing.T) {
+	host, clock := startPlugin(t, `{"minute": 1}`)
+
+	doRequest(host, nil)
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Fatalf("expected second request in the minute to be rejected")
+	}
+
+	clock.Advance(29 * time.Second)
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Fatalf("expected request at the end of the minute to be rejected")
+	}
+
+	clock.Advance(time.Second)
+	id, action := doRequest(host, nil)
+	if action != types.ActionContinue {
+		t.Fatalf("expected request in the next minute to continue")
+	}
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "X-RateLimit-Remaining-Minute", "0")
+}
+
+func TestRateLimitReset(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "hour": 10}`)
+
+	// Both limits have the same remaining hits: the longer window is reported
+	id, _ := doRequest(host, nil)
+	headers := host.GetCurrentResponseHeaders(id)
+	checkHeader(t, headers, "RateLimit-Reset", "2370")
+}
+
+func TestDayRollover(t *testing.T) {
+	host, clock := startPlugin(t, `{"day": 1}`)
+	clock.now = time.Date(2023, time.March, 15, 23, 59, 59, 0, time.UTC)
+
+	id, _ := doRequest(host, nil)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Reset", "1")
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Fatalf("expected second request in the day to be rejected")
+	}
+
+	clock.Advance(time.Second)
+	if _, action := doRequest(host, nil); action != types.ActionContinue {
+		t.Errorf("expected request on the next day to continue")
+	}
+}
+
+func TestMonthRollover(t *testing.T) {
+	host, clock := startPlugin(t, `{"month": 1}`)
+	clock.now = time.Date(2023, time.January, 31, 23, 59, 59, 0, time.UTC)
+
+	doRequest(host, nil)
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Fatalf("expected second request in the month to be rejected")
+	}
+
+	clock.Advance(time.Second)
+	if _, action := doRequest(host, nil); action != types.ActionContinue {
+		t.Errorf("expected request on the first day of the next month to continue")
+	}
+}
+
+func TestCalendarReset(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		conf  string
+		now   time.Time
+		reset string
+	}{
+		{"31-day month", `{"month": 5}`, time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC), "2678400"},
+		{"30-day month", `{"month": 5}`, time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC), "2592000"},
+		{"leap February", `{"month": 5}`, time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC), "2505600"},
+		{"leap year", `{"year": 5}`, time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), "31622400"},
+		{"end of year", `{"year": 5}`, time.Date(2023, time.December, 31, 0, 0, 0, 0, time.UTC), "86400"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			host, clock := startPlugin(t, tc.conf)
+			clock.now = tc.now
+
+			id, _ := doRequest(host, nil)
+			checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Reset", tc.reset)
+		})
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	host, clock := startPlugin(t, `{"day": 1, "timezone": "Asia/Tokyo"}`)
+
+	// 23:59:59 in Tokyo
+	clock.now = time.Date(2023, time.March, 15, 14, 59, 59, 0, time.UTC)
+
+	id, _ := doRequest(host, nil)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Reset", "1")
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Fatalf("expected second request in the day to be rejected")
+	}
+
+	clock.Advance(time.Second)
+	if _, action := doRequest(host, nil); action != types.ActionContinue {
+		t.Errorf("expected request after midnight in Tokyo to continue")
+	}
+}
+
+func TestTimezoneDST(t *testing.T) {
+	host, clock := startPlugin(t, `{"day": 1, "timezone": "Europe/Paris"}`)
+
+	// Clocks go forward on the last Sunday of March: that day lasts 23 hours
+	clock.now = time.Date(2023, time.March, 25, 23, 0, 0, 0, time.UTC)
+
+	id, _ := doRequest(host, nil)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Reset", "82800")
+}
+
+// -----------------------------------------------------------------------------
+// Batched Increments
+// -----------------------------------------------------------------------------
+
+func TestBatchFlush(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3, "flush_period": 50}`)
+	if period := host.GetTickPeriod(); period != 50 {
+		t.Errorf("expected tick period of 50ms, got %d", period)
+	}
+
+	key := getTestKey()
+	window := getTimestamps(testTime).start["minute"]
+
+	doRequest(host, nil)
+	id, _ := doRequest(host, nil)
+
+	// The worker counts its own hits before they are flushed
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "X-RateLimit-Remaining-Minute", "1")
+	if _, _, err := proxywasm.GetSharedData(key); err != types.ErrorStatusNotFound {
+		t.Fatalf("expected no write to the store before the flush, got %v", err)
+	}
+
+	host.Tick()
+	value, _, err := proxywasm.GetSharedData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := decodeRecord(value)
+	if v := rec.get("minute", window); v != 2 {
+		t.Errorf("expected 2 hits flushed, got %d", v)
+	}
+
+	doRequest(host, nil)
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Errorf("expected request over the limit to be rejected after a flush")
+	}
+}
+
+func TestBatchStoreFull(t *testing.T) {
+	host, clock := startPlugin(t, `{"minute": 3, "flush_period": 50, "store_full_policy": "fail_closed"}`)
+	fillStore(t)
+
+	key := getTestKey()
+	window := getTimestamps(testTime).start["minute"]
+
+	doRequest(host, nil)
+	host.Tick()
+	if n, _ := host.GetCounterMetric("rate_limiting_store_full"); n != 1 {
+		t.Errorf("expected the store full metric to be 1, got %d", n)
+	}
+
+	// Requests of a record which could not be flushed fail closed
+	id, _ := doRequest(host, nil)
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 503 {
+		t.Fatalf("expected a 503 response when the store is full")
+	}
+
+	// Pending hits are flushed once the store has room again
+	storeFull = false
+	clock.Advance(100 * time.Millisecond)
+	host.Tick()
+	value, _, err := proxywasm.GetSharedData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := decodeRecord(value)
+	if v := rec.get("minute", window); v != 1 {
+		t.Errorf("expected 1 hit flushed, got %d", v)
+	}
+
+	id, _ = doRequest(host, nil)
+	if resp := host.GetSentLocalResponse(id); resp != nil {
+		t.Fatalf("expected the request to be counted, got a %d response", resp.StatusCode)
+	}
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "X-RateLimit-Remaining-Minute", "1")
+}
+
+func TestBatchTickPeriod(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3, "flush_period": 500, "throttle": true}`)
+	if period := host.GetTickPeriod(); period != throttleTickPeriod {
+		t.Errorf("expected the shortest tick period, got %d", period)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Throttling
+// -----------------------------------------------------------------------------
+
+func TestThrottleResume(t *testing.T) {
+	host, clock := startPlugin(t, `{"second": 1, "throttle": true}`)
+
+	doRequest(host, nil)
+	id, action := doRequest(host, nil)
+	if action != types.ActionPause {
+		t.Fatalf("expected request over the limit to be held, got %v", action)
+	}
+	if host.GetSentLocalResponse(id) != nil {
+		t.Fatalf("expected held request not to be rejected")
+	}
+
+	host.Tick()
+	if host.GetCurrentHttpStreamAction(id) != types.ActionPause {
+		t.Fatalf("expected request to be held until the window resets")
+	}
+
+	clock.Advance(time.Second)
+	host.Tick()
+	if host.GetCurrentHttpStreamAction(id) != types.ActionContinue {
+		t.Errorf("expected request to be resumed once the window resets")
+	}
+}
+
+func TestThrottleMaxDelay(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "throttle": true, "throttle_max_delay": 5}`)
+
+	doRequest(host, nil)
+	id, _ := doRequest(host, nil)
+
+	resp := host.GetSentLocalResponse(id)
+	if resp == nil || resp.StatusCode != 429 {
+		t.Errorf("expected request that cannot be served in time to be rejected")
+	}
+}
+
+func TestThrottleMargin(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "graphql": true, "throttle": true, "throttle_max_delay": 60, "throttle_margin": 3}`)
+
+	id, _ := doGraphQLRequest(host, `{"query": "{ a b c d e f g h }"}`)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "2")
+
+	// Five hits over the limit
+	id, _ = doGraphQLRequest(host, `{"query": "{ a b c d e f g }"}`)
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 429 {
+		t.Errorf("expected a request further over the limit than the margin to be rejected")
+	}
+
+	// Three hits over the limit
+	id, action := doGraphQLRequest(host, `{"query": "{ a b c d e }"}`)
+	if action != types.ActionPause || host.GetSentLocalResponse(id) != nil {
+		t.Errorf("expected a request within the margin to be held")
+	}
+}
+
+func TestThrottleMaxQueue(t *testing.T) {
+	host, clock := startPlugin(t, `{"second": 1, "throttle": true, "throttle_max_queue": 2}`)
+
+	doRequest(host, nil)
+	first, _ := doRequest(host, nil)
+	second, _ := doRequest(host, nil)
+	third, _ := doRequest(host, nil)
+
+	if host.GetSentLocalResponse(first) != nil || host.GetSentLocalResponse(second) != nil {
+		t.Fatalf("expected requests to be held")
+	}
+	if resp := host.GetSentLocalResponse(third); resp == nil || resp.StatusCode != 429 {
+		t.Fatalf("expected request over the queue size to be rejected")
+	}
+
+	// One request gets through per second, in arrival order
+	clock.Advance(time.Second)
+	host.Tick()
+	if host.GetCurrentHttpStreamAction(first) != types.ActionContinue {
+		t.Errorf("expected first held request to be resumed")
+	}
+	if host.GetCurrentHttpStreamAction(second) != types.ActionPause {
+		t.Errorf("expected second held request to be held")
+	}
+
+	clock.Advance(time.Second)
+	host.Tick()
+	if host.GetCurrentHttpStreamAction(second) != types.ActionContinue {
+		t.Errorf("expected second held request to be resumed")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Cluster Policy
+// -----------------------------------------------------------------------------
+
+const clusterConf = `{"minute": 5, "policy": "cluster", "sync_upstream": "sync.internal:6510"}`
+
+func TestClusterSyncMergesTotals(t *testing.T) {
+	host, _ := startPlugin(t, clusterConf)
+
+	doRequest(host, nil)
+	doRequest(host, nil)
+
+	host.Tick()
+	callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+	if len(callouts) != 1 {
+		t.Fatalf("expected a sync call, got %d", len(callouts))
+	}
+	if callouts[0].Upstream != "sync.internal:6510" {
+		t.Errorf("unexpected sync upstream %q", callouts[0].Upstream)
+	}
+
+	window := getTimestamps(testTime).start["minute"]
+	key := getPeriodKey(getTestKey(), "minute")
+	expected := fmt.Sprintf("%d 2 %s\n", window, key)
+	if string(callouts[0].Body) != expected {
+		t.Fatalf("expected sync body %q, got %q", expected, callouts[0].Body)
+	}
+
+	// Other nodes counted 2 more hits
+	host.CallOnHttpCallResponse(callouts[0].CalloutID, [][2]string{{":status", "200"}}, nil,
+		[]byte(fmt.Sprintf("%d 4 %s\n", window, key)))
+
+	id, _ := doRequest(host, nil)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "X-RateLimit-Remaining-Minute", "0")
+	if _, action := doRequest(host, nil); action != types.ActionPause {
+		t.Errorf("expected request over the cluster-wide limit to be rejected")
+	}
+}
+
+func TestClusterSyncFailureKeepsDeltas(t *testing.T) {
+	host, clock := startPlugin(t, clusterConf)
+
+	doRequest(host, nil)
+
+	host.Tick()
+	callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+	host.CallOnHttpCallResponse(callouts[0].CalloutID, [][2]string{{":status", "503"}}, nil, nil)
+
+	doRequest(host, nil)
+
+	// No sync before the end of the sync period
+	host.Tick()
+	if n := len(host.GetCalloutAttributesFromContext(proxytest.PluginContextID)); n != 1 {
+		t.Fatalf("expected no sync call within the sync period, got %d calls", n)
+	}
+
+	clock.Advance(time.Second)
+	host.Tick()
+	callouts = host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+	if len(callouts) != 2 {
+		t.Fatalf("expected a second sync call, got %d calls", len(callouts))
+	}
+	window := getTimestamps(testTime).start["minute"]
+	key := getPeriodKey(getTestKey(), "minute")
+	if expected := fmt.Sprintf("%d 2 %s\n", window, key); string(callouts[1].Body) != expected {
+		t.Errorf("expected the hits of the failed sync to be pushed again as %q, got %q", expected, callouts[1].Body)
+	}
+}
+
+func TestClusterSyncWithoutResponse(t *testing.T) {
+	host, clock := startPlugin(t, clusterConf)
+
+	doRequest(host, nil)
+	host.Tick()
+	callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+	if len(callouts) != 1 {
+		t.Fatalf("expected a sync call, got %d", len(callouts))
+	}
+
+	// The host never calls back: the call is given up past its timeout
+	clock.Advance(400 * time.Millisecond)
+	host.Tick()
+	if len(host.GetErrorLogs()) != 0 {
+		t.Fatalf("expected the call to be pending within its timeout")
+	}
+
+	clock.Advance(600 * time.Millisecond)
+	host.Tick()
+	if len(host.GetErrorLogs()) == 0 {
+		t.Errorf("expected the call given up to be logged")
+	}
+	callouts = host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+	if len(callouts) != 2 {
+		t.Fatalf("expected a second sync call, got %d calls", len(callouts))
+	}
+	window := getTimestamps(testTime).start["minute"]
+	key := getPeriodKey(getTestKey(), "minute")
+	if expected := fmt.Sprintf("%d 1 %s\n", window, key); string(callouts[1].Body) != expected {
+		t.Errorf("expected the hits of the call given up to be pushed again as %q, got %q", expected, callouts[1].Body)
+	}
+
+	// A late response to the call given up is ignored
+	host.CallOnHttpCallResponse(callouts[0].CalloutID, [][2]string{{":status", "200"}}, nil,
+		[]byte(fmt.Sprintf("%d 5 %s\n", window, key)))
+	if _, action := doRequest(host, nil); action != types.ActionContinue {
+		t.Errorf("expected the totals of a late response to be ignored")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// gRPC Responses
+// -----------------------------------------------------------------------------
+
+var grpcHeaders = [][2]string{{":method", "POST"}, {"content-type", "application/grpc+proto"}}
+
+func TestGrpcRejection(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1}`)
+
+	doRequest(host, grpcHeaders)
+	id, action := doRequest(host, grpcHeaders)
+	if action != types.ActionPause {
+		t.Fatalf("expected request over the limit to pause, got %v", action)
+	}
+
+	resp := host.GetSentLocalResponse(id)
+	if resp == nil {
+		t.Fatalf("expected a local response")
+	}
+	if resp.StatusCode != 200 || len(resp.Data) != 0 {
+		t.Errorf("expected a trailers-only response, got status %d and %d bytes of body", resp.StatusCode, len(resp.Data))
+	}
+	checkHeader(t, resp.Headers, "content-type", "application/grpc")
+	checkHeader(t, resp.Headers, "grpc-status", "8")
+	checkHeader(t, resp.Headers, "grpc-message", "API rate limit exceeded")
+	checkHeader(t, resp.Headers, "Retry-After", "30")
+	checkHeader(t, resp.Headers, "RateLimit-Remaining", "0")
+
+	details, _ := getHeader(resp.Headers, "grpc-status-details-bin")
+	status, err := base64.RawStdEncoding.DecodeString(details)
+	if err != nil {
+		t.Fatalf("invalid grpc-status-details-bin %q: %v", details, err)
+	}
+
+	// Status { code: 8, message, details: [Any { RetryInfo { retry_delay: 30s } }] }
+	expected := []byte{0x08, 0x08, 0x12, 23}
+	expected = append(expected, "API rate limit exceeded"...)
+	expected = append(expected, 0x1a, 48, 0x0a, 40)
+	expected = append(expected, "type.googleapis.com/google.rpc.RetryInfo"...)
+	expected = append(expected, 0x12, 4, 0x0a, 2, 0x08, 30)
+	if !bytes.Equal(status, expected) {
+		t.Errorf("expected status details %x, got %x", expected, status)
+	}
+}
+
+func TestGrpcModeOff(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "grpc_mode": "off"}`)
+
+	doRequest(host, grpcHeaders)
+	id, _ := doRequest(host, grpcHeaders)
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 429 {
+		t.Fatalf("expected a 429 response")
+	}
+}
+
+func grpcCall(path string) [][2]string {
+	return append([][2]string{{":path", path}}, grpcHeaders...)
+}
+
+func TestGrpcMethodLimits(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3, "grpc_methods": {
+		"chat.v1.Chat": {"minute": 2},
+		"chat.v1.Chat/Stream": {"minute": 1},
+		"grpc.health.v1.Health": {}
+	}}`)
+
+	// The method takes precedence over its service
+	doRequest(host, grpcCall("/chat.v1.Chat/Stream"))
+	id, action := doRequest(host, grpcCall("/chat.v1.Chat/Stream"))
+	if action != types.ActionPause {
+		t.Fatalf("expected the second streaming call to be rejected")
+	}
+	checkHeader(t, host.GetSentLocalResponse(id).Headers, "RateLimit-Limit", "1")
+
+	// Other methods of the service share its counters, apart from the method
+	for i := 0; i < 2; i++ {
+		if _, action := doRequest(host, grpcCall("/chat.v1.Chat/Send")); action != types.ActionContinue {
+			t.Fatalf("expected call %d of the service to pass", i+1)
+		}
+	}
+	if _, action := doRequest(host, grpcCall("/chat.v1.Chat/List")); action != types.ActionPause {
+		t.Errorf("expected calls of the service to be counted together")
+	}
+
+	// Services without limits are not limited, nor counted
+	for i := 0; i < 5; i++ {
+		id, action := doRequest(host, grpcCall("/grpc.health.v1.Health/Check"))
+		if action != types.ActionContinue {
+			t.Fatalf("expected health checks to be unlimited")
+		}
+		if _, ok := getHeader(host.GetCurrentResponseHeaders(id), "RateLimit-Limit"); ok {
+			t.Errorf("expected no rate limiting headers for unlimited calls")
+		}
+	}
+
+	// Other services get the limits of the route
+	id, _ = doRequest(host, grpcCall("/users.v1.Users/Get"))
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Limit", "3")
+}
+
+func TestGrpcMethodWithoutLimits(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3, "aggregate": {"minute": 2}, "grpc_methods": {"grpc.health.v1.Health": {}}}`)
+
+	for i := 0; i < 5; i++ {
+		if _, action := doRequest(host, grpcCall("/grpc.health.v1.Health/Check")); action != types.ActionContinue {
+			t.Fatalf("expected health check %d to be exempt from aggregate limits", i+1)
+		}
+	}
+
+	// Exempt calls are not counted against aggregate limits either
+	for i := 0; i < 2; i++ {
+		if _, action := doRequest(host, grpcCall("/users.v1.Users/Get")); action != types.ActionContinue {
+			t.Fatalf("expected call %d within the aggregate limit to pass", i+1)
+		}
+	}
+	if _, action := doRequest(host, grpcCall("/users.v1.Users/Get")); action != types.ActionPause {
+		t.Errorf("expected the call over the aggregate limit to be rejected")
+	}
+}
+
+func TestGrpcMethodLimitsNotGrpc(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 3, "grpc_methods": {"chat.v1.Chat": {"minute": 1}}}`)
+
+	id, _ := doRequest(host, [][2]string{{":method", "POST"}, {":path", "/chat.v1.Chat/Send"}})
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Limit", "3")
+}
+
+func TestParseGrpcPath(t *testing.T) {
+	for _, tc := range []struct {
+		path    string
+		service string
+		method  string
+		ok      bool
+	}{
+		{"/chat.v1.Chat/Stream", "chat.v1.Chat", "Stream", true},
+		{"/Greeter/SayHello", "Greeter", "SayHello", true},
+		{"/chat.v1.Chat", "", "", false},
+		{"/chat.v1.Chat/", "", "", false},
+		{"/a/b/c", "", "", false},
+		{"chat.v1.Chat/Stream", "", "", false},
+	} {
+		service, method, ok := parseGrpcPath(tc.path)
+		if service != tc.service || method != tc.method || ok != tc.ok {
+			t.Errorf("parseGrpcPath(%q) = %q, %q, %v", tc.path, service, method, ok)
+		}
+	}
+}
+
+func TestEncodeGrpcMessage(t *testing.T) {
+	if got := encodeGrpcMessage("100% used\n\u00e9"); got != "100%25 used%0A%C3%A9" {
+		t.Errorf("unexpected encoded message %q", got)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Connection Limiting
+// -----------------------------------------------------------------------------
+
+func TestConnectionRate(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 2, "protocol": "tcp"}`)
+
+	for i := 0; i < 2; i++ {
+		if _, action := host.InitializeConnection(); action != types.ActionContinue {
+			t.Fatalf("connection %d: expected to continue, got %v", i+1, action)
+		}
+	}
+	if _, action := host.InitializeConnection(); action != types.ActionPause {
+		t.Errorf("expected connection over the limit to be closed")
+	}
+}
+
+func TestConnectionsCountedApart(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 2, "aggregate": {"minute": 3}, "protocol": "tcp", "scope": "global"}`)
+
+	// Requests from the same source went through an HTTP filter sharing the store
+	var rec counterRecord
+	rec.add("minute", getTimestamps(testTime).start["minute"], 3)
+	ctx := &RateLimitingContext{conf: &config.Config{}, scope: "global"}
+	for _, key := range []string{getLocalKey(ctx, "10.0.0.1"), getAggregateKey(ctx)} {
+		if err := proxywasm.SetSharedData(key, rec.encode(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, action := host.InitializeConnection(); action != types.ActionContinue {
+			t.Fatalf("expected connection %d to be counted apart from requests", i+1)
+		}
+	}
+	if _, action := host.InitializeConnection(); action != types.ActionPause {
+		t.Errorf("expected connection over the limit to be closed")
+	}
+}
+
+func TestConnectionsNotMigrated(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 2, "protocol": "tcp"}`)
+	setLegacyCounter(t, "minute", 2)
+
+	if _, action := host.InitializeConnection(); action != types.ActionContinue {
+		t.Errorf("expected connections not to carry over the counters of requests")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	props := newTestProperties()
+	host, _ := startPluginWithProperties(t, `{"protocol": "tcp", "max_connections": 1}`, props)
+
+	first, action := host.InitializeConnection()
+	if action != types.ActionContinue {
+		t.Fatalf("expected first connection to continue")
+	}
+
+	second, action := host.InitializeConnection()
+	if action != types.ActionPause {
+		t.Errorf("expected second open connection to be closed")
+	}
+	host.CompleteConnection(second)
+
+	// Other sources have connections of their own
+	props["ngx.remote_addr"] = "10.0.0.2"
+	if _, action := host.InitializeConnection(); action != types.ActionContinue {
+		t.Errorf("expected connection from another source to continue")
+	}
+
+	props["ngx.remote_addr"] = "10.0.0.1"
+	host.CompleteConnection(first)
+	if _, action := host.InitializeConnection(); action != types.ActionContinue {
+		t.Errorf("expected connection to continue once the first one is closed")
+	}
+}
+
+func TestMaxConnectionsOfDeadWorkers(t *testing.T) {
+	host, clock := startPlugin(t, `{"protocol": "tcp", "max_connections": 1, "scope": "global"}`)
+
+	// A worker which died left a connection of the source counted
+	key := getConnectionsKey(&RateLimitingContext{id: "10.0.0.1", scope: "global"})
+	slot := appendConnections([]byte{connectionsVersion}, 42, 1, testTime.Unix())
+	if err := proxywasm.SetSharedData(key, slot, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance((connectionsTTL - 1) * time.Second)
+	if _, action := host.InitializeConnection(); action != types.ActionPause {
+		t.Errorf("expected the connections of other workers to count")
+	}
+
+	clock.Advance(time.Second)
+	if _, action := host.InitializeConnection(); action != types.ActionContinue {
+		t.Errorf("expected the connections of a dead worker to expire")
+	}
+}
+
+func TestMaxConnectionsRenewal(t *testing.T) {
+	host, clock := startPlugin(t, `{"protocol": "tcp", "max_connections": 1, "scope": "global"}`)
+	if period := host.GetTickPeriod(); period != connectionsRenewal*1000 {
+		t.Errorf("expected a tick period of %ds, got %d", connectionsRenewal, period)
+	}
+
+	key := getConnectionsKey(&RateLimitingContext{id: "10.0.0.1", scope: "global"})
+	renewed := func() int64 {
+		slot, _, err := proxywasm.GetSharedData(key)
+		if err != nil || len(slot) != 25 {
+			t.Fatalf("expected the count of a single worker, got %v (%v)", slot, err)
+		}
+		return int64(binary.LittleEndian.Uint64(slot[17:]))
+	}
+
+	host.InitializeConnection()
+	if r := renewed(); r != testTime.Unix() {
+		t.Errorf("expected the count to be renewed when the connection opened, got %d", r)
+	}
+
+	clock.Advance(connectionsRenewal * time.Second)
+	host.Tick()
+	if r := renewed(); r != testTime.Unix()+connectionsRenewal {
+		t.Errorf("expected the count to be renewed on tick, got %d", r)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// GraphQL
+// -----------------------------------------------------------------------------
+
+func doGraphQLRequest(host proxytest.HostEmulator, body string) (uint32, types.Action) {
+	id := host.InitializeHttpContext()
+
+	headers := [][2]string{{":method", "POST"}, {":path", "/graphql"}, {"content-type", "application/json"}}
+	action := host.CallOnRequestHeaders(id, headers, false)
+	if action == types.ActionPause && host.GetSentLocalResponse(id) == nil {
+		action = host.CallOnRequestBody(id, []byte(body), true)
+	}
+	if action == types.ActionContinue {
+		host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}}, false)
+	}
+
+	return id, action
+}
+
+func TestGraphQLCost(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "graphql": true}`)
+
+	// Five fields: me, id, name, friends and their id
+	body := `{"query": "query Me { me { id name friends(first: 10) { id } } }"}`
+	id, _ := doGraphQLRequest(host, body)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "5")
+
+	id, _ = doGraphQLRequest(host, body)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "0")
+
+	id, action := doGraphQLRequest(host, `{"query": "query Me { me { id } }"}`)
+	if action != types.ActionPause {
+		t.Fatalf("expected the operation over the limit to be rejected")
+	}
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 429 {
+		t.Fatalf("expected a 429 response")
+	}
+}
+
+func TestGraphQLCostOverRemaining(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 4, "graphql": true}`)
+
+	doGraphQLRequest(host, `{"query": "{ a b }"}`)
+	id, action := doGraphQLRequest(host, `{"query": "{ a b c }"}`)
+	if action != types.ActionPause {
+		t.Fatalf("expected an operation costing more than the remaining hits to be rejected")
+	}
+	checkHeader(t, host.GetSentLocalResponse(id).Headers, "RateLimit-Remaining", "2")
+
+	if _, action := doGraphQLRequest(host, `{"query": "{ a b }"}`); action != types.ActionContinue {
+		t.Errorf("expected an operation within the remaining hits to pass")
+	}
+}
+
+func TestGraphQLOperationsCountedApart(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 1, "graphql": true, "graphql_cost": "none", "graphql_operations": ["A"]}`)
+
+	doc := `query A { a } query B { b } query C { c }`
+	body := func(name string) string {
+		return fmt.Sprintf(`{"query": %q, "operationName": %q, "variables": {}}`, doc, name)
+	}
+
+	doGraphQLRequest(host, body("A"))
+	if _, action := doGraphQLRequest(host, body("A")); action != types.ActionPause {
+		t.Errorf("expected the second A operation to be rejected")
+	}
+	if _, action := doGraphQLRequest(host, body("B")); action != types.ActionContinue {
+		t.Errorf("expected the B operation to be counted apart")
+	}
+
+	// Operations which are not listed are counted together
+	if _, action := doGraphQLRequest(host, body("C")); action != types.ActionPause {
+		t.Errorf("expected the C operation to be counted along with B")
+	}
+}
+
+func TestGraphQLDepth(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "graphql": true, "graphql_cost": "depth"}`)
+
+	id, _ := doGraphQLRequest(host, `{"query": "{ a { b { c } d } e }"}`)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "7")
+}
+
+func TestGraphQLInvalid(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "graphql": true}`)
+
+	tooDeep := fmt.Sprintf(`{"query": %q}`, strings.Repeat("{ a ", 70)+strings.Repeat("}", 70))
+	bodies := []string{`{"query": "{ a "}`, `{"query": 1}`, `{}`, `[]`, `[{"query": "{ a }"}, {}]`, tooDeep}
+	for _, body := range bodies {
+		id, action := doGraphQLRequest(host, body)
+		resp := host.GetSentLocalResponse(id)
+		if action != types.ActionPause || resp == nil || resp.StatusCode != 400 {
+			t.Errorf("expected %s to be rejected with a 400 response", body)
+		}
+	}
+}
+
+func TestGraphQLPersistedQuery(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "graphql": true}`)
+
+	// Sent by hash alone, the operation cannot be estimated
+	body := `{"operationName": "Me", "extensions": {"persistedQuery": {"version": 1, "sha256Hash": "ecf4edb4"}}}`
+	id, action := doGraphQLRequest(host, body)
+	if action != types.ActionContinue {
+		t.Fatalf("expected the persisted query to pass")
+	}
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "9")
+
+	// Sent along with its document, it is estimated as any
+	body = `{"query": "query Me { me { id } }", "extensions": {"persistedQuery": {"version": 1, "sha256Hash": "ecf4edb4"}}}`
+	id, _ = doGraphQLRequest(host, body)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "7")
+}
+
+func TestGraphQLBatch(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "graphql": true, "graphql_operations": ["A"]}`)
+
+	// Operations of a batch add up, and are not counted apart
+	id, _ := doGraphQLRequest(host, `[{"query": "query A { a b }"}, {"query": "{ c d e }"}]`)
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "5")
+
+	id, action := doGraphQLRequest(host, `[{"query": "query A { a b c }"}, {"query": "{ c d e }"}]`)
+	if action != types.ActionPause {
+		t.Fatalf("expected a batch costing more than the remaining hits to be rejected")
+	}
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 429 {
+		t.Fatalf("expected a 429 response")
+	}
+}
+
+func TestGraphQLTooLarge(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "graphql": true, "graphql_max_body": 16}`)
+
+	id, _ := doGraphQLRequest(host, `{"query": "{ a b c d e f g }"}`)
+	if resp := host.GetSentLocalResponse(id); resp == nil || resp.StatusCode != 413 {
+		t.Fatalf("expected a 413 response")
+	}
+}
+
+func TestGraphQLGet(t *testing.T) {
+	host, _ := startPlugin(t, `{"minute": 10, "graphql": true}`)
+
+	id, action := doRequest(host, [][2]string{{":method", "GET"}, {":path", "/graphql?query=%7B+a+b+%7D"}})
+	if action != types.ActionContinue {
+		t.Fatalf("expected the operation to pass, got %v", action)
+	}
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "8")
+
+	// Requests which are no GraphQL operation count as one hit
+	id, _ = doRequest(host, [][2]string{{":method", "OPTIONS"}, {":path", "/graphql"}})
+	checkHeader(t, host.GetCurrentResponseHeaders(id), "RateLimit-Remaining", "7")
+}
+
+func TestGetGraphQLOperation(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		query     string
+		operation string
+		costing   string
+		cost      int64
+		ok        bool
+	}{
+		{"shorthand", `{ a b }`, "", "fields", 2, true},
+		{"named", `query Q { a { b c } }`, "", "fields", 3, true},
+		{"aliases and arguments", `{ x: a(filter: {ids: [1, 2], name: "}"}) @include(if: $v) { b } }`, "", "fields", 2, true},
+		{"variables", `query Q($f: Filter = {a: {b: 1}}, $n: Int!) { a(n: $n) }`, "", "fields", 1, true},
+		{"strings and comments", "{ a(s: \"\"\"{ \\\"\"\" }\"\"\") # { b c\n d }", "", "fields", 2, true},
+		{"fragments", `{ a { ...F ...F } } fragment F on T { b c }`, "", "fields", 5, true},
+		{"inline fragments", `{ a { ... on T { b } ... @skip(if: true) { c } } }`, "", "fields", 3, true},
+		{"fragment depth", `{ a { ...F } } fragment F on T { b { c } }`, "", "depth", 3, true},
+		{"fragment cycle", `{ ...F } fragment F on T { a ...G } fragment G on T { ...F }`, "", "fields", 1, true},
+		{"selected operation", `query A { a } mutation B { b c }`, "B", "fields", 2, true},
+		{"unselected operation", `query A { a } query B { b }`, "", "fields", 0, false},
+		{"unknown operation", `query A { a }`, "B", "fields", 0, false},
+		{"no operation", `fragment F on T { a }`, "", "fields", 0, false},
+		{"empty selection", `{ }`, "", "fields", 0, false},
+		{"unterminated", `{ a(s: "x) }`, "", "fields", 0, false},
+		{"too deep", strings.Repeat("{ a ", 70) + strings.Repeat("}", 70), "", "depth", 0, false},
+		{"no cost", `{ a b c }`, "", "none", 1, true},
+	} {
+		_, cost, err := getGraphQLOperation(tc.query, tc.operation, tc.costing)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if cost != tc.cost {
+			t.Errorf("%s: expected cost %d, got %d", tc.name, tc.cost, cost)
+		}
+	}
+
+	if name, _, _ := getGraphQLOperation(`query Q { a }`, "", "none"); name != "Q" {
+		t.Errorf("expected the name of the only operation, got %q", name)
+	}
+}
+
+func TestParseGraphQLBody(t *testing.T) {
+	deep := strings.Repeat("[", 65536)
+	for _, tc := range []struct {
+		name      string
+		body      string
+		query     string
+		operation string
+		ok        bool
+	}{
+		{"fields", `{"query": "{ me { id } }", "variables": {"a": [1, {"b": null}]}, "operationName": null, "extensions": {}}`, "{ me { id } }", "Default", true},
+		{"operation name", `{"query": "query Q { a }", "operationName": "Q"}`, "query Q { a }", "Q", true},
+		{"escapes", `{"query": "{ a(s: \"\u00e9\ud83d\ude00\n\") }"}`, "{ a(s: \"é😀\n\") }", "Default", true},
+		{"nested variables", `{"variables": ` + strings.Repeat("[", 10000) + strings.Repeat("]", 10000) + `, "query": "{ a }"}`, "{ a }", "Default", true},
+		{"unbalanced variables", `{"query": "{ a }", "variables": ` + deep + `}`, "", "", false},
+		{"non-string query", `{"query": 1}`, "", "", false},
+		{"unterminated", `{"query": "{ a }"`, "", "", false},
+		{"trailing data", `{"query": "{ a }"} {}`, "", "", false},
+	} {
+		reqs, err := parseGraphQLBody([]byte(tc.body), "Default")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if tc.ok && (reqs[0].query != tc.query || reqs[0].operationName != tc.operation) {
+			t.Errorf("%s: unexpected query %q and operation %q", tc.name, reqs[0].query, reqs[0].operationName)
+		}
+	}
+
+	reqs, err := parseGraphQLBody([]byte(`[{"query": "{ a }"}, {"operationName": "Q", "extensions": {"persistedQuery": {"version": 1}}}]`), "Default")
+	if err != nil || len(reqs) != 2 {
+		t.Fatalf("expected a batch of two requests, got %v, %v", reqs, err)
+	}
+	if reqs[0].operationName != "" || reqs[0].persisted || reqs[1].operationName != "Q" || !reqs[1].persisted {
+		t.Errorf("unexpected requests %+v", reqs)
+	}
+	for _, body := range []string{`[]`, `[{"query": "{ a }"} {"query": "{ b }"}]`, `[{"query": "{ a }"},]`} {
+		if _, err := parseGraphQLBody([]byte(body), ""); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
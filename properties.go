@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// -----------------------------------------------------------------------------
+// Properties
+// -----------------------------------------------------------------------------
+
+// PropertyGetter reads a property from the host, so that tests can provide
+// properties the host emulator lacks.
+type PropertyGetter func(path []string) ([]byte, error)
+
+// Property is a value the filter needs from the host, found under a
+// different path on each host
+type Property string
+
+const (
+	routeProperty      Property = "route id"
+	serviceProperty    Property = "service id"
+	remoteAddrProperty Property = "remote address"
+)
+
+// Host holds the paths of properties on a given proxy
+type Host struct {
+	name  string
+	paths map[Property][]string
+}
+
+var kongHost = &Host{"kong", map[Property][]string{
+	routeProperty:      {"kong", "route_id"},
+	serviceProperty:    {"kong", "service_id"},
+	remoteAddrProperty: {"ngx", "remote_addr"},
+}}
+
+var envoyHost = &Host{"envoy", map[Property][]string{
+	routeProperty:      {"xds", "route_name"},
+	serviceProperty:    {"xds", "cluster_name"},
+	remoteAddrProperty: {"source", "address"},
+}}
+
+// Hosts tried in turn when detecting the host
+var hosts = []*Host{kongHost, envoyHost}
+
+func getHost(name string) *Host {
+	for _, h := range hosts {
+		if h.name == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// Properties resolves properties for a plugin context. Unless configured,
+// the host is detected from the first property found, and later lookups
+// only use its paths. Properties missing from the host are reported once.
+type Properties struct {
+	get     PropertyGetter
+	host    *Host
+	missing map[Property]bool
+}
+
+func newProperties(get PropertyGetter) *Properties {
+	if get == nil {
+		get = proxywasm.GetProperty
+	}
+
+	return &Properties{
+		get:     get,
+		missing: make(map[Property]bool),
+	}
+}
+
+// lookup returns the value of the property at the path, if not empty
+func (p *Properties) lookup(path []string) (string, bool) {
+	value, err := p.get(path)
+	if err != nil || len(value) == 0 {
+		return "", false
+	}
+	return string(value), true
+}
+
+// getString returns the value of the property, if the host has it
+func (p *Properties) getString(prop Property) (string, bool) {
+	candidates := hosts
+	if p.host != nil {
+		candidates = []*Host{p.host}
+	}
+
+	for _, h := range candidates {
+		if value, ok := p.lookup(h.paths[prop]); ok {
+			if p.host == nil {
+				p.host = h
+				proxywasm.LogInfof("detected %s host", h.name)
+			}
+			return value, true
+		}
+	}
+
+	if !p.missing[prop] {
+		p.missing[prop] = true
+		proxywasm.LogWarnf("%s is not available from the host", prop)
+	}
+	return "", false
+}
+
+// stripPort returns the address without its port, if any: Envoy gives the
+// source address as host:port, or [host]:port for IPv6
+func stripPort(addr string) string {
+	if strings.HasPrefix(addr, "[") {
+		if end := strings.Index(addr, "]"); end != -1 {
+			return addr[1:end]
+		}
+		return addr
+	}
+	if strings.Count(addr, ":") == 1 {
+		return addr[:strings.Index(addr, ":")]
+	}
+	return addr
+}
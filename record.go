@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// -----------------------------------------------------------------------------
+// Counter Records
+// -----------------------------------------------------------------------------
+
+// The counters of all periods for a key are packed in a single record, so
+// that a request does one read and one write per key instead of one per
+// period. Integers are little-endian:
+//
+//	offset   size  field
+//	0        1     version of the layout, recordVersion
+//	1+16*i   8     start of the window of the i-th period, ordered as periods
+//	9+16*i   8     hits in that window
+//
+// Records of another version are treated as empty. A period whose window
+// has passed counts as no hits.
+
+const recordVersion = 1
+
+// Number of periods in a record, that is len(periods)
+const recordPeriods = 6
+
+const recordSize = 1 + 16*recordPeriods
+
+type counterRecord struct {
+	window [recordPeriods]int64
+	hits   [recordPeriods]int64
+	slot   []byte // slot the record was read from, for records in slots
+}
+
+func periodIndex(period string) int {
+	for i, p := range periods {
+		if p == period {
+			return i
+		}
+	}
+	panic("unknown period " + period)
+}
+
+func decodeRecord(buf []byte) counterRecord {
+	if len(buf) < recordSize || buf[0] != recordVersion {
+		return counterRecord{}
+	}
+	return decodeCounters(buf[1:])
+}
+
+// decodeCounters decodes the fields of a record following its version
+func decodeCounters(buf []byte) counterRecord {
+	var rec counterRecord
+	for i := 0; i < recordPeriods; i++ {
+		rec.window[i] = int64(binary.LittleEndian.Uint64(buf[16*i:]))
+		rec.hits[i] = int64(binary.LittleEndian.Uint64(buf[8+16*i:]))
+	}
+	return rec
+}
+
+func (rec *counterRecord) encode() []byte {
+	buf := make([]byte, recordSize)
+	buf[0] = recordVersion
+	rec.encodeCounters(buf[1:])
+	return buf
+}
+
+func (rec *counterRecord) encodeCounters(buf []byte) {
+	for i := 0; i < recordPeriods; i++ {
+		binary.LittleEndian.PutUint64(buf[16*i:], uint64(rec.window[i]))
+		binary.LittleEndian.PutUint64(buf[8+16*i:], uint64(rec.hits[i]))
+	}
+}
+
+// get returns the hits of the period in the given window
+func (rec *counterRecord) get(period string, window int64) int64 {
+	i := periodIndex(period)
+	if rec.window[i] != window {
+		return 0
+	}
+	return rec.hits[i]
+}
+
+// add counts hits of the period in the given window, which replaces an
+// earlier one. Hits of an earlier window than the recorded one are dropped.
+func (rec *counterRecord) add(period string, window int64, hits int64) {
+	i := periodIndex(period)
+	if window > rec.window[i] {
+		rec.window[i] = window
+		rec.hits[i] = 0
+	}
+	if window == rec.window[i] {
+		rec.hits[i] += hits
+	}
+}
+
+// set replaces the hits of the period in the given window
+func (rec *counterRecord) set(period string, window int64, hits int64) {
+	i := periodIndex(period)
+	if window >= rec.window[i] {
+		rec.window[i] = window
+		rec.hits[i] = hits
+	}
+}
+
+// readRecord returns the record of the key, along with its cas
+func readRecord(key string) (counterRecord, uint32, error) {
+	return readRecordOrMigrate(key, nil)
+}
+
+// readRecordOrMigrate returns the record of the key or, when there is none
+// yet, the record migrate builds from the counters of earlier versions
+func readRecordOrMigrate(key string, migrate func() counterRecord) (counterRecord, uint32, error) {
+	slotKey, owner, inSlot := splitSlotKey(key)
+
+	buf, cas, err := getSharedData(slotKey)
+	if err != nil && err != types.ErrorStatusNotFound {
+		return counterRecord{}, 0, err
+	}
+
+	rec, found := counterRecord{}, err == nil
+	if inSlot {
+		rec, found = findSlotRecord(buf, owner)
+		rec.slot = buf
+	} else if found {
+		rec = decodeRecord(buf)
+	}
+	if !found && migrate != nil {
+		rec = migrate()
+		rec.slot = buf
+	}
+	return rec, cas, nil
+}
+
+// Maximum number of migrated records remembered per worker
+const maxLegacyRecords = 1024
+
+// legacyRecords remembers the records built from the counters of earlier
+// versions, so that those are read once per worker rather than on every
+// request of an identifier which has no record yet, such as one whose
+// requests are all rejected. It is emptied when full, at the cost of
+// reading again.
+type legacyRecords struct {
+	records map[string]counterRecord
+}
+
+func newLegacyRecords() *legacyRecords {
+	return &legacyRecords{records: make(map[string]counterRecord)}
+}
+
+// get returns the record migrated for the key, migrating it the first time
+func (l *legacyRecords) get(key string, migrate func() counterRecord) counterRecord {
+	if rec, ok := l.records[key]; ok {
+		return rec
+	}
+	if len(l.records) >= maxLegacyRecords {
+		l.records = make(map[string]counterRecord)
+	}
+	rec := migrate()
+	l.records[key] = rec
+	return rec
+}
+
+// readLegacyCounter reads a counter kept by versions before records, as the
+// hits of a single window in 8 bytes. Missing or malformed counters count as
+// no hits. Counters are left alone, as the ABI cannot delete them.
+func readLegacyCounter(key string) int64 {
+	buf, _, err := getSharedData(key)
+	if err != nil || len(buf) != 8 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(buf))
+}
+
+var errStoreFull = errors.New("counter store is full")
+
+// updateRecord applies update to the record last read and writes it,
+// retrying with an updated record when it was changed concurrently. Nothing
+// is written if update returns false.
+func updateRecord(key string, rec counterRecord, cas uint32, update func(rec *counterRecord) bool) error {
+	slotKey, owner, inSlot := splitSlotKey(key)
+
+	for i := 0; i < 10; i++ {
+		if !update(&rec) {
+			return nil
+		}
+
+		value, evicted := rec.encode(), false
+		if inSlot {
+			value, evicted = putSlotRecord(rec.slot, owner, &rec)
+		}
+
+		err := setSharedData(slotKey, value, cas)
+		if err == nil && evicted {
+			evictionCounter.Increment(1)
+		}
+		// The host reports the failure to allocate a key in a full store
+		// as an internal failure, like any other. Records and slots keep
+		// their size, so that rewriting one allocates nothing: only a
+		// failure to add a key, read as missing, is taken for a full store.
+		if err == types.ErrorInternalFailure && cas == 0 {
+			return errStoreFull
+		}
+		if err != types.ErrorStatusCasMismatch {
+			return err
+		}
+
+		// Get updated record, updated cas and retry
+		rec, cas, err = readRecord(key)
+		if err != nil {
+			return err
+		}
+	}
+	return types.ErrorStatusCasMismatch
+}
+
+// -----------------------------------------------------------------------------
+// Counter Slots
+// -----------------------------------------------------------------------------
+
+// With counter_slots set, the records of identifiers are kept in that many
+// keys, so that the store holds a bounded number of them however many
+// identifiers come by. Each key is a slot holding the records of up to
+// slotWays identifiers hashed to it, from the most to the least recently
+// counted. A new identifier takes the place of the least recently counted
+// one of a full slot, whose counters are lost. The key of a record in a
+// slot is the key of the slot, then # and the hexadecimal owner of the
+// record, a non-zero hash of the identifier telling it apart in the slot.
+//
+//	offset     size  field
+//	0          1     version of the layout, slotVersion
+//	1+104*j    8     owner of the j-th record, 0 if unused
+//	9+104*j    96    the record, without its version
+//
+// Slots of another version are treated as empty.
+
+const slotVersion = 1
+
+// Number of records in a slot
+const slotWays = 4
+
+const slotRecordSize = 8 + recordSize - 1
+
+const slotSize = 1 + slotWays*slotRecordSize
+
+func getSlotKey(slot string, owner uint64) string {
+	return fmt.Sprintf("%s#%016x", slot, owner)
+}
+
+// splitSlotKey returns the key of the slot and the owner of a record in a
+// slot, or the key itself if the record has a key of its own
+func splitSlotKey(key string) (string, uint64, bool) {
+	i := strings.LastIndexByte(key, '#')
+	if i < 0 {
+		return key, 0, false
+	}
+	owner, err := strconv.ParseUint(key[i+1:], 16, 64)
+	if err != nil || owner == 0 {
+		return key, 0, false
+	}
+	return key[:i], owner, true
+}
+
+func findSlotRecord(slot []byte, owner uint64) (counterRecord, bool) {
+	if len(slot) != slotSize || slot[0] != slotVersion {
+		return counterRecord{}, false
+	}
+	for j := 0; j < slotWays; j++ {
+		buf := slot[1+slotRecordSize*j:]
+		if binary.LittleEndian.Uint64(buf) == owner {
+			return decodeCounters(buf[8:]), true
+		}
+	}
+	return counterRecord{}, false
+}
+
+// putSlotRecord returns the slot with the record of the owner first,
+// followed by the other records in their order. The last one is evicted if
+// the slot was full without the owner.
+func putSlotRecord(slot []byte, owner uint64, rec *counterRecord) ([]byte, bool) {
+	buf := make([]byte, slotSize)
+	buf[0] = slotVersion
+	binary.LittleEndian.PutUint64(buf[1:], owner)
+	rec.encodeCounters(buf[9:])
+
+	if len(slot) != slotSize || slot[0] != slotVersion {
+		return buf, false
+	}
+
+	n := 1
+	for j := 0; j < slotWays; j++ {
+		r := slot[1+slotRecordSize*j : 1+slotRecordSize*(j+1)]
+		o := binary.LittleEndian.Uint64(r)
+		if o == 0 || o == owner {
+			continue
+		}
+		if n == slotWays {
+			return buf, true
+		}
+		copy(buf[1+slotRecordSize*n:], r)
+		n++
+	}
+	return buf, false
+}
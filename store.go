@@ -0,0 +1,16 @@
+//go:build !proxytest
+
+package main
+
+import "github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+
+// getSharedData and setSharedData access the store of the host, whose
+// failures test builds emulate instead (see store_proxytest.go)
+
+func getSharedData(key string) ([]byte, uint32, error) {
+	return proxywasm.GetSharedData(key)
+}
+
+func setSharedData(key string, value []byte, cas uint32) error {
+	return proxywasm.SetSharedData(key, value, cas)
+}
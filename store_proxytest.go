@@ -0,0 +1,32 @@
+//go:build proxytest
+
+package main
+
+import (
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// The host emulator of proxytest never fails a read nor runs out of memory,
+// so test builds emulate a failing or full store as hosts report them (see
+// store.go)
+var (
+	storeReadError error // returned by every read when set
+	storeFull      bool  // no key can be added
+)
+
+func getSharedData(key string) ([]byte, uint32, error) {
+	if storeReadError != nil {
+		return nil, 0, storeReadError
+	}
+	return proxywasm.GetSharedData(key)
+}
+
+func setSharedData(key string, value []byte, cas uint32) error {
+	if storeFull {
+		if _, _, err := proxywasm.GetSharedData(key); err == types.ErrorStatusNotFound {
+			return types.ErrorInternalFailure
+		}
+	}
+	return proxywasm.SetSharedData(key, value, cas)
+}
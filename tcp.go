@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// -----------------------------------------------------------------------------
+// Connection Limiting Context
+// -----------------------------------------------------------------------------
+
+// ConnectionLimitingContext limits TCP connections per source address. New
+// connections count as hits against the limits, in counters of their own
+// and the same windows as requests, and open connections are capped by
+// max_connections.
+type ConnectionLimitingContext struct {
+	types.DefaultTcpContext
+	rl          *RateLimitingContext
+	connections *Connections
+	open        bool // counted among the open connections of the source
+}
+
+// closeConnection rejects the connection
+func closeConnection(reason string) types.Action {
+	proxywasm.LogDebugf("closing connection: %s", reason)
+	if err := proxywasm.CloseDownstream(); err != nil {
+		proxywasm.LogErrorf("could not close connection: %v", err)
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+func (c *ConnectionLimitingContext) OnNewConnection() types.Action {
+	ctx := c.rl
+	conf := ctx.conf
+	ts := getTimestamps(ctx.clock.Now().In(ctx.location))
+
+	ctx.id = Identifier(getForwardedIp(ctx.properties))
+	ctx.scope = getScope(ctx)
+
+	// Counters which could not all be read tell nothing reliable: the
+	// connection is neither checked nor counted against the limits
+	counters, stop, err := getUsage(ctx, ctx.id, ts)
+	usable := err == nil
+	if err != nil {
+		proxywasm.LogErrorf("failed to get usage: %v", err)
+
+		if !conf.FaultTolerant {
+			return closeConnection("counters unavailable")
+		}
+	} else if stop != "" {
+		return closeConnection("rate limit exceeded")
+	}
+
+	if conf.MaxConnections != -1 {
+		open, err := c.connections.add(getConnectionsKey(ctx), 1, ts.now)
+		if err != nil {
+			proxywasm.LogErrorf("could not count open connections: %v", err)
+
+			if !conf.FaultTolerant {
+				return closeConnection("counters unavailable")
+			}
+		} else {
+			c.open = true
+			if open > conf.MaxConnections {
+				c.release()
+				return closeConnection("too many open connections")
+			}
+		}
+	}
+
+	if !usable {
+		return types.ActionContinue
+	}
+
+	err = localPolicyIncrement(ctx, counters, ts)
+	if err == errStoreFull && conf.StoreFullPolicy == "fail_closed" {
+		c.release()
+		return closeConnection("counter store is full")
+	}
+
+	return types.ActionContinue
+}
+
+// release stops counting the connection among the open ones
+func (c *ConnectionLimitingContext) release() {
+	if !c.open {
+		return
+	}
+	c.open = false
+
+	if _, err := c.connections.add(getConnectionsKey(c.rl), -1, c.rl.clock.Now().Unix()); err != nil {
+		proxywasm.LogErrorf("could not release connection: %v", err)
+	}
+}
+
+func (c *ConnectionLimitingContext) OnStreamDone() {
+	c.release()
+}
+
+// -----------------------------------------------------------------------------
+// Open Connections
+// -----------------------------------------------------------------------------
+
+// Open connections of a source are counted in a slot holding the count of
+// each worker with connections open, along with when the worker last
+// renewed it. Workers renew their counts every connectionsRenewal seconds
+// while connections are open, so that the counts of workers which died or
+// were reloaded are dropped once they are connectionsTTL seconds old.
+// Integers are little-endian:
+//
+//	offset    size  field
+//	0         1     version of the layout, connectionsVersion
+//	1+24*i    8     owner of the i-th count, a random id of its worker
+//	9+24*i    8     connections the owner has open
+//	17+24*i   8     when the owner last renewed the count, in Unix seconds
+//
+// Slots of another version are treated as empty.
+
+const connectionsVersion = 1
+
+const connectionsRenewal = 20
+
+const connectionsTTL = 60
+
+func getConnectionsKey(ctx *RateLimitingContext) string {
+	return getCounterKey(ctx.namespace, "connections", ctx.scope, string(ctx.id))
+}
+
+// Connections counts the connections the worker has open, per source
+type Connections struct {
+	owner       uint64
+	open        map[string]int64
+	nextRenewal int64
+}
+
+func newConnections() *Connections {
+	// The SDK offers no id for workers
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		proxywasm.LogErrorf("could not generate a worker id: %v", err)
+	}
+	return &Connections{
+		owner: binary.LittleEndian.Uint64(buf[:]) | 1,
+		open:  make(map[string]int64),
+	}
+}
+
+// add adds delta to the open connections of the worker and returns the
+// number of connections open by all workers
+func (c *Connections) add(key string, delta int64, now int64) (int64, error) {
+	open := max(0, c.open[key]+delta)
+	total, err := writeConnections(key, c.owner, open, now)
+	if err != nil {
+		return 0, err
+	}
+
+	if open == 0 {
+		delete(c.open, key)
+	} else {
+		c.open[key] = open
+	}
+	return total, nil
+}
+
+// onTick renews the counts of the connections open by the worker
+func (c *Connections) onTick(now time.Time) {
+	if now.Unix() < c.nextRenewal {
+		return
+	}
+	c.nextRenewal = now.Unix() + connectionsRenewal
+
+	for key, open := range c.open {
+		if _, err := writeConnections(key, c.owner, open, now.Unix()); err != nil {
+			proxywasm.LogErrorf("could not renew open connections %q: %v", key, err)
+		}
+	}
+}
+
+// writeConnections sets the count of the owner in the slot, dropping the
+// expired counts, and returns the total of the counts. It retries when the
+// slot was changed concurrently.
+func writeConnections(key string, owner uint64, open int64, now int64) (int64, error) {
+	for i := 0; i < 10; i++ {
+		buf, cas, err := getSharedData(key)
+		if err != nil && err != types.ErrorStatusNotFound {
+			return 0, err
+		}
+
+		total := open
+		slot := []byte{connectionsVersion}
+		if open > 0 {
+			slot = appendConnections(slot, owner, open, now)
+		}
+		if len(buf) > 0 && buf[0] == connectionsVersion {
+			for j := 1; j+24 <= len(buf); j += 24 {
+				o := binary.LittleEndian.Uint64(buf[j:])
+				n := int64(binary.LittleEndian.Uint64(buf[j+8:]))
+				renewed := int64(binary.LittleEndian.Uint64(buf[j+16:]))
+				if o == owner || renewed+connectionsTTL <= now {
+					continue
+				}
+				total += n
+				slot = appendConnections(slot, o, n, renewed)
+			}
+		}
+
+		err = setSharedData(key, slot, cas)
+		if err != types.ErrorStatusCasMismatch {
+			return total, err
+		}
+	}
+	return 0, types.ErrorStatusCasMismatch
+}
+
+func appendConnections(slot []byte, owner uint64, open int64, renewed int64) []byte {
+	slot = binary.LittleEndian.AppendUint64(slot, owner)
+	slot = binary.LittleEndian.AppendUint64(slot, uint64(open))
+	return binary.LittleEndian.AppendUint64(slot, uint64(renewed))
+}
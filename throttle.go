@@ -0,0 +1,135 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kong/proxy-wasm-go-rate-limiting/config"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// -----------------------------------------------------------------------------
+// Throttling
+// -----------------------------------------------------------------------------
+
+// Period, in milliseconds, at which held requests are checked again
+const throttleTickPeriod = 100
+
+type heldRequest struct {
+	ctx      *RateLimitingContext
+	due      int64 // when the request is checked against the limits again
+	deadline int64 // when the request is rejected if it still exceeds the limits
+}
+
+// Throttle holds requests exceeding the limits by a small margin and
+// resumes them once the limiting window resets, instead of rejecting them
+// right away. Requests are queued per identifier, in arrival order.
+type Throttle struct {
+	conf *config.Config
+	held map[Identifier][]*heldRequest
+}
+
+func newThrottle(conf *config.Config) *Throttle {
+	return &Throttle{
+		conf: conf,
+		held: make(map[Identifier][]*heldRequest),
+	}
+}
+
+func (t *Throttle) find(ctx *RateLimitingContext) int {
+	for i, req := range t.held[ctx.id] {
+		if req.ctx == ctx {
+			return i
+		}
+	}
+	return -1
+}
+
+// hold queues the request, exceeding the limit by over hits, until it can be
+// checked again after reset seconds. It returns false if the request cannot
+// be served within the maximum delay, the queue for its identifier is full,
+// or the hits over the limit along with those of the queued requests exceed
+// the margin, in which case it must be rejected.
+func (t *Throttle) hold(ctx *RateLimitingContext, reset int64, over int64, ts *Timestamps) bool {
+	now := ts.now
+
+	// A request checked again keeps its place at the head of the queue
+	if i := t.find(ctx); i != -1 {
+		req := t.held[ctx.id][i]
+		if now+reset > req.deadline {
+			return false
+		}
+		req.due = now + reset
+		return true
+	}
+
+	queue := t.held[ctx.id]
+	if reset > t.conf.ThrottleMaxDelay || int64(len(queue)) >= t.conf.ThrottleMaxQueue {
+		return false
+	}
+
+	// Queued requests are served first, so this one is further over the limit
+	for _, req := range queue {
+		over += req.ctx.cost
+	}
+	if over > t.conf.ThrottleMargin {
+		return false
+	}
+
+	t.held[ctx.id] = append(queue, &heldRequest{
+		ctx:      ctx,
+		due:      now + reset,
+		deadline: now + t.conf.ThrottleMaxDelay,
+	})
+
+	return true
+}
+
+// release removes the request from the queue, if held.
+func (t *Throttle) release(ctx *RateLimitingContext) {
+	i := t.find(ctx)
+	if i == -1 {
+		return
+	}
+
+	queue := append(t.held[ctx.id][:i], t.held[ctx.id][i+1:]...)
+	if len(queue) == 0 {
+		delete(t.held, ctx.id)
+	} else {
+		t.held[ctx.id] = queue
+	}
+}
+
+func (t *Throttle) onTick(now time.Time) {
+	ts := getTimestamps(now)
+
+	for id, queue := range t.held {
+		for len(queue) > 0 && queue[0].due <= ts.now {
+			req := queue[0]
+
+			err := proxywasm.SetEffectiveContext(req.ctx.contextID)
+			if err != nil {
+				proxywasm.LogErrorf("could not resume throttled request: %v", err)
+				t.release(req.ctx)
+				queue = t.held[id]
+				continue
+			}
+
+			action := rateLimit(req.ctx, ts)
+			if req.due > ts.now {
+				// Still over the limit: held again at the head of the queue
+				break
+			}
+
+			t.release(req.ctx)
+			queue = t.held[id]
+
+			if action == types.ActionContinue {
+				if err := proxywasm.ResumeHttpRequest(); err != nil {
+					proxywasm.LogErrorf("could not resume throttled request: %v", err)
+				}
+			}
+		}
+	}
+}
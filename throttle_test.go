@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kong/proxy-wasm-go-rate-limiting/config"
+)
+
+func TestThrottleHold(t *testing.T) {
+	throttle := newThrottle(&config.Config{ThrottleMaxQueue: 10, ThrottleMaxDelay: 5, ThrottleMargin: 10})
+	now := time.Unix(1678875630, 0)
+	ts := getTimestamps(now)
+	ctx := &RateLimitingContext{id: "10.0.0.1", cost: 1}
+
+	if !throttle.hold(ctx, 3, 1, ts) {
+		t.Fatalf("expected a request resetting within the maximum delay to be held")
+	}
+	if len(throttle.held[ctx.id]) != 1 || throttle.held[ctx.id][0].due != now.Unix()+3 {
+		t.Fatalf("expected the request to be queued until the reset")
+	}
+
+	throttle.release(ctx)
+	if _, ok := throttle.held[ctx.id]; ok {
+		t.Errorf("expected the empty queue of the identifier to be removed")
+	}
+
+	if throttle.hold(ctx, 6, 1, ts) {
+		t.Errorf("expected a request resetting past the maximum delay to be rejected")
+	}
+}
+
+func TestThrottleHoldAgain(t *testing.T) {
+	throttle := newThrottle(&config.Config{ThrottleMaxQueue: 10, ThrottleMaxDelay: 5, ThrottleMargin: 10})
+	ts := getTimestamps(time.Unix(1678875630, 0))
+	first := &RateLimitingContext{id: "10.0.0.1", cost: 1}
+	second := &RateLimitingContext{id: "10.0.0.1", cost: 1}
+
+	throttle.hold(first, 2, 1, ts)
+	throttle.hold(second, 2, 1, ts)
+
+	// Held again, the request keeps its place but not its deadline
+	if !throttle.hold(first, 4, 1, ts) || throttle.held[first.id][0].ctx != first {
+		t.Fatalf("expected the request to be held again at the head of the queue")
+	}
+	if throttle.hold(first, 6, 1, ts) {
+		t.Errorf("expected a request held again past its deadline to be rejected")
+	}
+}
+
+func TestThrottleHoldQueueFull(t *testing.T) {
+	throttle := newThrottle(&config.Config{ThrottleMaxQueue: 2, ThrottleMaxDelay: 5, ThrottleMargin: 10})
+	ts := getTimestamps(time.Unix(1678875630, 0))
+
+	for i := 0; i < 2; i++ {
+		if !throttle.hold(&RateLimitingContext{id: "10.0.0.1", cost: 1}, 1, 1, ts) {
+			t.Fatalf("expected request %d to be held", i+1)
+		}
+	}
+	if throttle.hold(&RateLimitingContext{id: "10.0.0.1", cost: 1}, 1, 1, ts) {
+		t.Errorf("expected a request over the queue size to be rejected")
+	}
+	if !throttle.hold(&RateLimitingContext{id: "10.0.0.2", cost: 1}, 1, 1, ts) {
+		t.Errorf("expected queues to be kept per identifier")
+	}
+}
+
+func TestThrottleHoldMargin(t *testing.T) {
+	throttle := newThrottle(&config.Config{ThrottleMaxQueue: 10, ThrottleMaxDelay: 5, ThrottleMargin: 3})
+	ts := getTimestamps(time.Unix(1678875630, 0))
+
+	if throttle.hold(&RateLimitingContext{id: "10.0.0.1", cost: 4}, 1, 4, ts) {
+		t.Fatalf("expected a request further over the limit than the margin to be rejected")
+	}
+	if !throttle.hold(&RateLimitingContext{id: "10.0.0.1", cost: 2}, 1, 2, ts) {
+		t.Fatalf("expected a request within the margin to be held")
+	}
+
+	// Requests queued ahead count against the margin
+	if throttle.hold(&RateLimitingContext{id: "10.0.0.1", cost: 2}, 1, 2, ts) {
+		t.Errorf("expected a request over the margin along with the queued ones to be rejected")
+	}
+	if !throttle.hold(&RateLimitingContext{id: "10.0.0.1", cost: 1}, 1, 1, ts) {
+		t.Errorf("expected a request within the margin along with the queued ones to be held")
+	}
+}
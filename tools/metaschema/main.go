@@ -0,0 +1,30 @@
+// Command metaschema writes the filter meta file, holding the schema of
+// its configuration, from the definition of config.Config.
+//
+// Usage: go run ./tools/metaschema <path to rate-limiting.meta.json>
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kong/proxy-wasm-go-rate-limiting/config"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: metaschema <output file>")
+		os.Exit(2)
+	}
+
+	data, err := config.MetaSchema()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error generating meta schema: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(os.Args[1], data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing meta schema: %v\n", err)
+		os.Exit(1)
+	}
+}
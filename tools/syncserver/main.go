@@ -0,0 +1,76 @@
+// Command syncserver is a minimal in-memory upstream for the cluster
+// policy, adding the deltas pushed by every node and answering totals,
+// to try the policy locally. See cluster.go for the protocol.
+//
+// Usage: go run ./tools/syncserver [listen address, :6510 by default]
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type counter struct {
+	window int64
+	total  int64
+}
+
+type server struct {
+	mu       sync.Mutex
+	counters map[string]*counter
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var resp strings.Builder
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		window, err1 := strconv.ParseInt(fields[0], 10, 64)
+		delta, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		key := fields[2]
+
+		c := s.counters[key]
+		if c == nil || c.window < window {
+			c = &counter{window: window}
+			s.counters[key] = c
+		}
+		if c.window == window {
+			c.total += delta
+		}
+
+		fmt.Fprintf(&resp, "%d %d %s\n", c.window, c.total, key)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(resp.String()))
+}
+
+func main() {
+	addr := ":6510"
+	if len(os.Args) > 1 {
+		addr = os.Args[1]
+	}
+
+	log.Printf("listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, &server{counters: make(map[string]*counter)}))
+}